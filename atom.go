@@ -0,0 +1,229 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// We fetch no more than this many entries to embed their full text, this
+// many at a time, and give up on any we haven't fetched in maxFullFeedTime.
+const maxFullFeedEntries = 20
+const maxFullFeedFetches = 4
+const maxFullFeedTime = 20 * time.Second
+
+// atomLink is the link element of an Atom feed or entry.
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// atomContent is the HTML content of an Atom entry. Base lets feed readers
+// resolve the proxy's relative links.
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Base string `xml:"xml:base,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atomEntry is an entry of the Atom feeds we serve.
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	ID        string       `xml:"id"`
+	Link      atomLink     `xml:"link"`
+	Published string       `xml:"published,omitempty"`
+	Updated   string       `xml:"updated"`
+	Content   *atomContent `xml:"content,omitempty"`
+}
+
+// atomOutput is an Atom (RFC 4287) feed we serve to HTTP feed readers.
+type atomOutput struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// proxyBase returns the URL of Gneto itself, as requested by r.
+func proxyBase(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host + "/"
+	}
+	return "http://" + r.Host + "/"
+}
+
+// writeAtomFeed writes the feed at u, titled title, to w as Atom, with
+// links through the proxy at base. self is the path and query by which the
+// feed reader asked for it. If full is true, it fetches the newest entries,
+// as user, to include their text.
+func writeAtomFeed(w io.Writer, base string, self string, u *url.URL, title string, entries []feedEntry, full bool, user string) error {
+	now := time.Now().UTC()
+	af := atomOutput{
+		Title: title,
+		ID:    u.String(),
+		Links: []atomLink{
+			{Href: base + "?url=" + geminiQueryEscape(u.String()), Rel: "alternate", Type: "text/html"},
+			{Href: strings.TrimSuffix(base, "/") + self, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	if af.Title == "" {
+		af.Title = u.String()
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Published.After(entries[j].Published)
+	})
+
+	var contents []string
+	if full {
+		contents = feedContents(entries, user)
+	}
+
+	var updated time.Time
+	for i, e := range entries {
+		published := e.Published
+		if published.IsZero() {
+			published = now
+		}
+		if published.After(updated) {
+			updated = published
+		}
+		ae := atomEntry{
+			Title:     e.Title,
+			ID:        e.URL,
+			Link:      atomLink{Href: base + "?url=" + geminiQueryEscape(e.URL), Rel: "alternate"},
+			Published: published.Format(time.RFC3339),
+			Updated:   published.Format(time.RFC3339),
+		}
+		if i < len(contents) && contents[i] != "" {
+			ae.Content = &atomContent{Type: "html", Base: base, Body: contents[i]}
+		}
+		af.Entries = append(af.Entries, ae)
+	}
+	if updated.IsZero() {
+		updated = now
+	}
+	af.Updated = updated.Format(time.RFC3339)
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	return enc.Encode(af)
+}
+
+// feedContents fetches the text of the first maxFullFeedEntries entries,
+// as user, and returns it as HTML. It leaves empty the text of entries it
+// couldn't fetch within maxFullFeedTime.
+func feedContents(entries []feedEntry, user string) []string {
+	n := len(entries)
+	if n > maxFullFeedEntries {
+		n = maxFullFeedEntries
+	}
+
+	type fetched struct {
+		i       int
+		content string
+	}
+	results := make(chan fetched, n)
+	slots := make(chan struct{}, maxFullFeedFetches)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			defer func() { <-slots }()
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			content, err := feedContentHTML(entries[i].URL, user)
+			if err != nil {
+				log.Printf("feedContents: failed to fetch %s: %v", entries[i].URL, err)
+			}
+			results <- fetched{i, content}
+		}(i)
+	}
+
+	contents := make([]string, n)
+	timeout := time.NewTimer(maxFullFeedTime)
+	defer timeout.Stop()
+	for got := 0; got < n; got++ {
+		select {
+		case f := <-results:
+			contents[f.i] = f.content
+		case <-timeout.C:
+			log.Printf("feedContents: gave up after fetching %d of %d entries in %v", got, n, maxFullFeedTime)
+			return contents
+		}
+	}
+
+	return contents
+}
+
+// feedContentHTML fetches the Gemini page at rawURL, with user's client
+// certificate, if any, and returns it as HTML, with links through the proxy.
+func feedContentHTML(rawURL string, user string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "gemini" {
+		return "", nil
+	}
+	meta, body, err := fetchGemini(u, user, optMaxGemtext)
+	if err != nil {
+		return "", err
+	}
+	if meta == "" {
+		meta = "text/gemini"
+	}
+	if !strings.HasPrefix(meta, "text/") {
+		return "", nil
+	}
+
+	rd, _, ok := decodeText(bufio.NewReader(bytes.NewReader(body)), meta)
+	if !ok {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if !strings.HasPrefix(meta, "text/gemini") {
+		text, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString("<pre>\n" + htmlEscaper.Replace(string(text)) + "</pre>\n")
+		return buf.String(), nil
+	}
+
+	doc, err := parseGemini(rd)
+	if err != nil {
+		return "", err
+	}
+	err = writeGeminiHTML(&buf, u, doc, gemRenderOptions{})
+	return buf.String(), err
+}
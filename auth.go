@@ -0,0 +1,178 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// After a failed login, an IP address must wait loginBackoff before trying
+// again, doubling with each further failure up to maxLoginBackoff.
+const loginBackoff = time.Second
+const maxLoginBackoff = 15 * time.Minute
+
+// loginFailures tracks failed logins from one IP address.
+type loginFailures struct {
+	count int
+	until time.Time
+}
+
+// checkSharedPassword reports whether password is the shared password.
+// The 'password' setting may hold the password itself, or a hash of it made
+// with --hashpassword.
+func checkSharedPassword(password string) bool {
+	shared := stringOption(&envPassword)
+	if shared == "" {
+		return false
+	}
+	if strings.HasPrefix(shared, "pbkdf2-sha256$") {
+		return checkPassword(shared, password)
+	}
+	return subtle.ConstantTimeCompare([]byte(shared), []byte(password)) == 1
+}
+
+// remoteIP returns the IP address r came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginDelay returns how long r's IP address must still wait before it
+// may try to log in again.
+func loginDelay(r *http.Request) time.Duration {
+	muLoginFailures.Lock()
+	defer muLoginFailures.Unlock()
+
+	f, ok := failedLogins[remoteIP(r)]
+	if !ok {
+		return 0
+	}
+	return time.Until(f.until)
+}
+
+// failLogin records a failed login from r's IP address, and returns how
+// long that address must wait before trying again.
+func failLogin(r *http.Request) time.Duration {
+	muLoginFailures.Lock()
+	defer muLoginFailures.Unlock()
+
+	ip := remoteIP(r)
+	f, ok := failedLogins[ip]
+	if !ok {
+		f = &loginFailures{}
+		failedLogins[ip] = f
+	}
+	f.count++
+	delay := maxLoginBackoff
+	if f.count <= 10 {
+		delay = loginBackoff << (f.count - 1)
+		if delay > maxLoginBackoff {
+			delay = maxLoginBackoff
+		}
+	}
+	f.until = time.Now().Add(delay)
+
+	return delay
+}
+
+// succeedLogin forgets the failed logins from r's IP address.
+func succeedLogin(r *http.Request) {
+	muLoginFailures.Lock()
+	delete(failedLogins, remoteIP(r))
+	muLoginFailures.Unlock()
+}
+
+// purgeLoginFailures forgets IP addresses whose last failed login was
+// long ago.
+func purgeLoginFailures() {
+	muLoginFailures.Lock()
+	defer muLoginFailures.Unlock()
+
+	for ip, f := range failedLogins {
+		if time.Since(f.until) > 24*time.Hour {
+			delete(failedLogins, ip)
+		}
+	}
+}
+
+// csrfToken returns the token that forms on the page we're making for r
+// must send back, setting the "csrf" cookie that holds it, if need be.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie("csrf"); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	b := make([]byte, 32)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		log.Println("csrfToken:", err)
+	}
+	c := http.Cookie{
+		Name:     "csrf",
+		Value:    base64.StdEncoding.EncodeToString(b),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, &c)
+	// Later calls for the same request must return the same token.
+	r.AddCookie(&c)
+
+	return c.Value
+}
+
+// redirectToLogin sends the browser to the login page, which sends it back
+// to the page it asked for once the user logs in. We use 303 so that a POST
+// from an expired session doesn't reach the login form as a wrong password.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	target := "/login"
+	if r.Method == http.MethodGet {
+		target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// localURL returns next if it's a path on this server, or "/" if it's
+// anything else, so that the login form can't send users to other sites.
+func localURL(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+// checkCSRF reports whether r may change anything: it isn't a POST, or it
+// carries the token from our "csrf" cookie.
+func checkCSRF(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return true
+	}
+	c, err := r.Cookie("csrf")
+	if err != nil || c.Value == "" {
+		log.Println("checkCSRF: POST without a CSRF cookie from", r.RemoteAddr)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.FormValue("csrf"))) != 1 {
+		log.Println("checkCSRF: POST with a bad CSRF token from", r.RemoteAddr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// bookmark is a saved link.
+type bookmark struct {
+	URL   string
+	Title string
+}
+
+// Href returns the link to b, through the proxy if we can proxy it.
+func (b bookmark) Href() string {
+	u, err := url.Parse(b.URL)
+	if err == nil && proxiedScheme(u.Scheme) {
+		return "/?url=" + geminiQueryEscape(b.URL)
+	}
+	return b.URL
+}
+
+// bookmarkFolder is a named group of bookmarks. The folder with an empty
+// name holds bookmarks that aren't in any folder.
+type bookmarkFolder struct {
+	Name      string
+	Bookmarks []bookmark
+}
+
+// bookmarkStore keeps bookmarks in a text/gemini file, with a heading for
+// each folder, so the file also works as a --home page.
+type bookmarkStore struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	file    string
+	folders []bookmarkFolder
+}
+
+// newBookmarkStore returns the bookmarks stored in file, which need not exist yet.
+func newBookmarkStore(file string) (*bookmarkStore, error) {
+	bs := &bookmarkStore{file: file}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return bs, nil
+	}
+	if err != nil {
+		return bs, fmt.Errorf("newBookmarkStore: failed to open '%s': %v", file, err)
+	}
+	defer f.Close()
+
+	_, skipped, err := bs.importGemini(f)
+	if err != nil {
+		return bs, fmt.Errorf("newBookmarkStore: failed to read '%s': %v", file, err)
+	}
+	for _, l := range skipped {
+		log.Printf("newBookmarkStore: skipping relative link '%s' in '%s'", l, file)
+	}
+
+	return bs, err
+}
+
+// add saves a bookmark for rawURL in folder, replacing any existing
+// bookmark for rawURL. The caller must hold bs.mu.
+func (bs *bookmarkStore) add(rawURL, title, folder string) {
+	bs.remove(rawURL)
+	if title == "" {
+		title = rawURL
+	}
+	for i := range bs.folders {
+		if bs.folders[i].Name == folder {
+			bs.folders[i].Bookmarks = append(bs.folders[i].Bookmarks, bookmark{URL: rawURL, Title: title})
+			return
+		}
+	}
+	f := bookmarkFolder{Name: folder, Bookmarks: []bookmark{{URL: rawURL, Title: title}}}
+	if folder == "" {
+		// Bookmarks outside any folder come first, before the first heading.
+		bs.folders = append([]bookmarkFolder{f}, bs.folders...)
+		return
+	}
+	bs.folders = append(bs.folders, f)
+}
+
+// remove deletes the bookmark for rawURL, and any folder it leaves empty.
+// It reports whether there was such a bookmark. The caller must hold bs.mu.
+func (bs *bookmarkStore) remove(rawURL string) bool {
+	for i := range bs.folders {
+		for j, b := range bs.folders[i].Bookmarks {
+			if b.URL != rawURL {
+				continue
+			}
+			bs.folders[i].Bookmarks = append(bs.folders[i].Bookmarks[:j], bs.folders[i].Bookmarks[j+1:]...)
+			if len(bs.folders[i].Bookmarks) == 0 {
+				bs.folders = append(bs.folders[:i], bs.folders[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// delete removes the bookmark for rawURL, and saves the bookmarks.
+func (bs *bookmarkStore) delete(rawURL string) error {
+	bs.mu.Lock()
+	found := bs.remove(rawURL)
+	bs.mu.Unlock()
+	if !found {
+		return fmt.Errorf("bookmarkStore: no bookmark for %s", rawURL)
+	}
+
+	return bs.save()
+}
+
+// find returns the bookmark for rawURL, and its folder.
+func (bs *bookmarkStore) find(rawURL string) (bookmark, string, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, f := range bs.folders {
+		for _, b := range f.Bookmarks {
+			if b.URL == rawURL {
+				return b, f.Name, true
+			}
+		}
+	}
+	return bookmark{}, "", false
+}
+
+// list returns a copy of the bookmarks, by folder.
+func (bs *bookmarkStore) list() []bookmarkFolder {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	folders := make([]bookmarkFolder, 0, len(bs.folders))
+	for _, f := range bs.folders {
+		folders = append(folders, bookmarkFolder{Name: f.Name, Bookmarks: append([]bookmark{}, f.Bookmarks...)})
+	}
+	return folders
+}
+
+// importGemini adds the links in the text/gemini document rd to the
+// bookmarks, skipping any we already have, and returns how many it added.
+// Second- and third-level headings name folders, as in bookmarks exported
+// by Lagrange; the first-level heading is the document's title.
+// Links before any folder heading are not in a folder, as in Amfora's
+// bookmarks page. We skip relative links, which have nothing to resolve
+// against, and return them.
+func (bs *bookmarkStore) importGemini(rd io.Reader) (int, []string, error) {
+	doc, err := parseGemini(bufio.NewReader(rd))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	have := make(map[string]bool)
+	for _, f := range bs.folders {
+		for _, b := range f.Bookmarks {
+			have[b.URL] = true
+		}
+	}
+
+	added := 0
+	var skipped []string
+	folder := ""
+	for _, l := range doc.Lines {
+		switch l.Type {
+		case gemHeading2, gemHeading3:
+			folder = l.Text
+		case gemLink:
+			if u, err := url.Parse(l.URL); err != nil || !u.IsAbs() {
+				skipped = append(skipped, l.URL)
+				continue
+			}
+			if have[l.URL] {
+				continue
+			}
+			have[l.URL] = true
+			bs.add(l.URL, l.Text, folder)
+			added++
+		}
+	}
+
+	return added, skipped, err
+}
+
+// writeGemini writes the bookmarks to w as a text/gemini document.
+func (bs *bookmarkStore) writeGemini(w io.Writer) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Bookmarks\n")
+	for _, f := range bs.folders {
+		bw.WriteString("\n")
+		if f.Name != "" {
+			bw.WriteString("## " + f.Name + "\n")
+		}
+		for _, b := range f.Bookmarks {
+			bw.WriteString("=> " + b.URL + " " + b.Title + "\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+// put saves a bookmark for rawURL in folder, replacing any bookmark for
+// oldURL (when we edit a bookmark's URL) or rawURL, and saves the bookmarks.
+func (bs *bookmarkStore) put(oldURL, rawURL, title, folder string) error {
+	rawURL = cleanBookmarkText(rawURL)
+	if rawURL == "" || strings.ContainsAny(rawURL, " \t") {
+		return fmt.Errorf("bookmarkStore: invalid URL '%s'", rawURL)
+	}
+
+	bs.mu.Lock()
+	if oldURL != "" {
+		bs.remove(oldURL)
+	}
+	bs.add(rawURL, cleanBookmarkText(title), cleanBookmarkText(folder))
+	bs.mu.Unlock()
+
+	return bs.save()
+}
+
+// save writes the bookmarks to their file.
+func (bs *bookmarkStore) save() error {
+	bs.saveMu.Lock()
+	defer bs.saveMu.Unlock()
+
+	var buf bytes.Buffer
+	err := bs.writeGemini(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := bs.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("bookmarkStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, bs.file)
+}
+
+// cleanBookmarkText keeps text from breaking a line of the bookmarks file.
+func cleanBookmarkText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
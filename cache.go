@@ -0,0 +1,191 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// responseCache is an LRU cache of raw Gemini responses (header and body),
+// keyed by URL, with an optional on-disk second tier.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+	dir     string
+}
+
+type cacheEntry struct {
+	key      string
+	response []byte
+	stored   time.Time
+}
+
+// cacheRecorder passes reads through from r, keeping a copy of up to max bytes.
+// The copy is complete if we read to EOF without exceeding max.
+type cacheRecorder struct {
+	r        io.Reader
+	buf      bytes.Buffer
+	max      int64
+	eof      bool
+	overflow bool
+}
+
+func (cr *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if !cr.overflow {
+		if int64(cr.buf.Len()+n) > cr.max {
+			cr.overflow = true
+			cr.buf.Reset()
+		} else {
+			cr.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		cr.eof = true
+	}
+	return n, err
+}
+
+// complete returns the recorded response, or nil if we didn't record all of it.
+func (cr *cacheRecorder) complete() []byte {
+	if !cr.eof || cr.overflow {
+		return nil
+	}
+	return cr.buf.Bytes()
+}
+
+// newResponseCache returns a cache holding up to maxSize bytes in memory,
+// for up to ttl. If dir is not empty, it also keeps responses there.
+func newResponseCache(maxSize int64, ttl time.Duration, dir string) *responseCache {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Printf("newResponseCache: disabling on-disk cache, because we failed to create '%s': %v", dir, err)
+			dir = ""
+		}
+	}
+
+	return &responseCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
+		dir:     dir,
+	}
+}
+
+// diskPath returns the path of the on-disk cache file for key.
+func (rc *responseCache) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(rc.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the fresh cached response for key, if any.
+func (rc *responseCache) get(key string) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if el, ok := rc.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Since(e.stored) < rc.ttl {
+			rc.lru.MoveToFront(el)
+			return e.response, true
+		}
+		rc.remove(el)
+	}
+
+	if rc.dir == "" {
+		return nil, false
+	}
+	fi, err := os.Stat(rc.diskPath(key))
+	if err != nil || time.Since(fi.ModTime()) >= rc.ttl {
+		return nil, false
+	}
+	response, err := ioutil.ReadFile(rc.diskPath(key))
+	if err != nil {
+		return nil, false
+	}
+	rc.add(&cacheEntry{key: key, response: response, stored: fi.ModTime()})
+
+	return response, true
+}
+
+// put caches response for key.
+func (rc *responseCache) put(key string, response []byte) {
+	if int64(len(response)) > rc.maxSize {
+		return
+	}
+	e := &cacheEntry{key: key, response: append([]byte{}, response...), stored: time.Now()}
+
+	rc.mu.Lock()
+	if el, ok := rc.entries[key]; ok {
+		rc.remove(el)
+	}
+	rc.add(e)
+	rc.mu.Unlock()
+
+	if rc.dir != "" {
+		err := ioutil.WriteFile(rc.diskPath(key), e.response, 0600)
+		if err != nil {
+			log.Printf("responseCache: failed to write on-disk cache for %s: %v", key, err)
+		}
+	}
+}
+
+// add puts e at the front of the LRU list, evicting the least recently used
+// entries as necessary. The caller must hold rc.mu.
+func (rc *responseCache) add(e *cacheEntry) {
+	rc.entries[e.key] = rc.lru.PushFront(e)
+	rc.size += int64(len(e.response))
+	for rc.size > rc.maxSize && rc.lru.Len() > 0 {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove drops el from memory. The caller must hold rc.mu.
+func (rc *responseCache) remove(el *list.Element) {
+	e := rc.lru.Remove(el).(*cacheEntry)
+	delete(rc.entries, e.key)
+	rc.size -= int64(len(e.response))
+}
+
+// purgeOldCacheFiles removes expired responses from the on-disk cache.
+func purgeOldCacheFiles(rc *responseCache) {
+	for {
+		files, err := ioutil.ReadDir(rc.dir)
+		if err != nil {
+			log.Printf("purgeOldCacheFiles: failed to read cache directory '%s': %v", rc.dir, err)
+		}
+		purged := 0
+		for _, fi := range files {
+			if time.Since(fi.ModTime()) < rc.ttl {
+				continue
+			}
+			if err := os.Remove(path.Join(rc.dir, fi.Name())); err == nil {
+				purged++
+			}
+		}
+
+		if optLogLevel > 1 {
+			log.Printf("purgeOldCacheFiles: purged %d expired responses", purged)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
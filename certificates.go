@@ -6,14 +6,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/big"
 	mathrand "math/rand"
@@ -21,72 +30,195 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 )
 
 type clientCertificate struct {
-	Cert     tls.Certificate
-	CertName string
-	Expires  string
-	Host     string
-	Path     []string
-	URL      string
-	Leaf     *x509.Certificate
+	Cert      tls.Certificate
+	CertName  string
+	Expires   string
+	Host      string
+	Path      []string
+	URL       string
+	Leaf      *x509.Certificate
+	Transient bool
+	User      string
 }
 
 type persistentCert struct {
 	URL     string `json:"url"`
 	CertPEM string `json:"certPEM"`
 	KeyPEM  string `json:"keyPEM"`
+	User    string `json:"user,omitempty"`
 }
 
 type serverCertificate struct {
-	host    string
-	expires time.Time
-	cert    string
+	host      string
+	expires   time.Time
+	cert      string
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// serverCertInfo describes a server certificate for display in templates.
+type serverCertInfo struct {
+	Host        string
+	Fingerprint string
+	Expires     time.Time
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// certMismatchError reports that a server sent a certificate other than the
+// one we trust for it, and that --strict refuses to proceed.
+type certMismatchError struct {
+	Old serverCertificate
+	New serverCertificate
+}
+
+func (e *certMismatchError) Error() string {
+	return fmt.Sprintf("TLS certificate for %s does not match the trusted certificate", e.New.host)
+}
+
+// acceptServerCert resolves a pending certificate mismatch for host.
+// If permanent, the new certificate replaces the trusted one; otherwise,
+// the new certificate is trusted for the next request only.
+func acceptServerCert(host string, permanent bool) error {
+	muServerCerts.Lock()
+	defer muServerCerts.Unlock()
+
+	pc, ok := pendingServerCerts[host]
+	if !ok {
+		return fmt.Errorf("acceptServerCert: no pending certificate for %s", host)
+	}
+	delete(pendingServerCerts, host)
+
+	if !permanent {
+		acceptedServerCerts[host] = pc.cert
+		return nil
+	}
+
+	pinServerCert(pc, true)
+
+	return nil
+}
+
+// addClientCert adds c to clientCerts.
+func addClientCert(c clientCertificate) {
+	muClientCerts.Lock()
+	clientCerts = append(clientCerts, c)
+	if c.Transient {
+		clientCertsChanged = true
+	}
+	muClientCerts.Unlock()
 }
 
 // checkServerCert checks the Gemini server cert against known certs (TOFU).
-func checkServerCert(u *url.URL, conn *tls.Conn) string {
+// It returns a warning for the user if the cert changed. With --strict, it
+// instead returns a *certMismatchError, unless the user accepted the new
+// cert once by way of acceptServerCert.
+func checkServerCert(u *url.URL, conn *tls.Conn) (string, error) {
+	var err error
 	var warning string
 
+	if optTrust {
+		return warning, err
+	}
+
+	now := time.Now()
 	pc := serverCertificate{
-		host:    u.Host,
-		expires: conn.ConnectionState().PeerCertificates[0].NotAfter,
-		cert:    base64.StdEncoding.EncodeToString(conn.ConnectionState().PeerCertificates[0].Raw),
+		host:      u.Host,
+		expires:   conn.ConnectionState().PeerCertificates[0].NotAfter,
+		cert:      base64.StdEncoding.EncodeToString(conn.ConnectionState().PeerCertificates[0].Raw),
+		firstSeen: now,
+		lastSeen:  now,
 	}
 
 	muServerCerts.Lock()
+	found := false
 	for i, c := range serverCerts {
-		if c.host == pc.host {
-			if c.cert == pc.cert {
+		if c.host != pc.host {
+			continue
+		}
+		found = true
+		if c.cert == pc.cert {
+			serverCerts[i].lastSeen = now
+			serverCertsChanged = true
+			break
+		}
+		if optStrict {
+			if acceptedServerCerts[pc.host] == pc.cert {
+				delete(acceptedServerCerts, pc.host)
+				warning = fmt.Sprintf("The TLS certificate %s sent does not match the certificate it sent last time. You accepted the new certificate for this request only.", c.host)
 				break
-			} else {
-				warning = fmt.Sprintf("The TLS certificate %s sent does not match the certificate it sent last time, which was set to expire on %v. However, we will proceed with the request, and trust the new certificate in the future.", c.host, c.expires)
-				serverCerts[i].cert = pc.cert
-				serverCerts[i].expires = pc.expires
-				serverCertsChanged = true
-			}
-		} else {
-			if i == len(serverCerts)-1 {
-				serverCerts = append(serverCerts, pc)
-				serverCertsChanged = true
 			}
+			pendingServerCerts[pc.host] = pc
+			err = &certMismatchError{Old: c, New: pc}
+			break
 		}
+		warning = fmt.Sprintf("The TLS certificate %s sent does not match the certificate it sent last time, which was set to expire on %v. However, we will proceed with the request, and trust the new certificate in the future.", c.host, c.expires)
+		serverCerts[i].cert = pc.cert
+		serverCerts[i].expires = pc.expires
+		serverCerts[i].lastSeen = now
+		serverCertsChanged = true
+		break
 	}
-	if len(serverCerts) == 0 {
+	if !found {
 		serverCerts = append(serverCerts, pc)
 		serverCertsChanged = true
 	}
 	muServerCerts.Unlock()
 
-	return warning
+	return warning, err
+}
+
+// clientCertFromPEM returns a client certificate to be sent to servers at rawURL.
+func clientCertFromPEM(rawURL string, certPEM string, keyPEM string) (clientCertificate, error) {
+	var c clientCertificate
+	var err error
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return c, fmt.Errorf("clientCertFromPEM: failed to parse URL %s: %v", rawURL, err)
+	}
+	c.URL = rawURL
+	c.Cert, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return c, fmt.Errorf("clientCertFromPEM: failed to parse client certificate PEM data for %s: %v", rawURL, err)
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Cert.Certificate[0])
+	if err != nil {
+		return c, fmt.Errorf("clientCertFromPEM: failed to parse certificate leaf for %s: %v", rawURL, err)
+	}
+	c.Expires = c.Leaf.NotAfter.String()
+	c.CertName = c.Leaf.Subject.CommonName
+	c.Host = u.Host
+	c.Path = strings.Split(u.Path, "/")
+
+	return c, err
 }
 
-// deleteClientCert removes the TLS client certificate from clientCerts that
-// best matches URL u. Returns a non-nil error if no client cert matches the URL.
-func deleteClientCert(u *url.URL) error {
+// configPath returns the path of the named file in our config directory.
+func configPath(name string) (string, error) {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("configPath: unable to find config directory: %v", err)
+	}
+	d = path.Join(d, "gneto")
+	err = os.MkdirAll(d, 0700)
+	if err != nil {
+		return "", fmt.Errorf("configPath: unable to create config directory '%s': %v", d, err)
+	}
+
+	return path.Join(d, name), err
+}
+
+// deleteClientCert removes the TLS client certificate of user from
+// clientCerts that best matches URL u. Returns a non-nil error if no client
+// cert matches the URL.
+func deleteClientCert(u *url.URL, user string) error {
 	var err error
 	var bestMatchIndex int
 	var bestMatchScore int
@@ -94,14 +226,15 @@ func deleteClientCert(u *url.URL) error {
 	splitPath := strings.Split(u.Path, "/")
 
 	muClientCerts.Lock()
+	defer muClientCerts.Unlock()
 
 	for i, c := range clientCerts {
-		if u.Host != c.Host {
+		if u.Host != c.Host || c.User != user {
 			continue
 		}
 		score := 1
 		for i, p := range splitPath {
-			if p == c.Path[i] {
+			if i < len(c.Path) && p == c.Path[i] {
 				score++
 			}
 		}
@@ -123,17 +256,246 @@ func deleteClientCert(u *url.URL) error {
 			newCerts = append(newCerts, c)
 		}
 		clientCerts = newCerts
+		clientCertsChanged = true
 		if optLogLevel > 1 {
 			log.Printf("deleteClientCert: deleted client certificate for %s", u.String())
 		}
 	} else {
 		err = fmt.Errorf("deleteClientCert: no certificate found matching URL '%s'", u.String())
 	}
-	muClientCerts.Unlock()
 
 	return err
 }
 
+// deleteUserClientCerts removes every client certificate of user from
+// clientCerts.
+func deleteUserClientCerts(user string) {
+	muClientCerts.Lock()
+	defer muClientCerts.Unlock()
+
+	kept := make([]clientCertificate, 0, len(clientCerts))
+	for _, c := range clientCerts {
+		if c.User != user {
+			kept = append(kept, c)
+		} else if c.Transient {
+			clientCertsChanged = true
+		}
+	}
+	clientCerts = kept
+}
+
+// exportServerCerts writes serverCerts to w in the TOFU cache file format.
+func exportServerCerts(w io.Writer) error {
+	muServerCerts.RLock()
+	defer muServerCerts.RUnlock()
+	for _, c := range serverCerts {
+		_, err := io.WriteString(w, c.tofuLine())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findClientCert returns user's client certificate for exactly rawURL.
+func findClientCert(rawURL string, user string) (clientCertificate, bool) {
+	muClientCerts.RLock()
+	defer muClientCerts.RUnlock()
+	for _, c := range clientCerts {
+		if c.URL == rawURL && c.User == user {
+			return c, true
+		}
+	}
+
+	return clientCertificate{}, false
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate as colon-separated hex.
+func (c serverCertificate) fingerprint() string {
+	raw, err := base64.StdEncoding.DecodeString(c.cert)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	hexSum := make([]string, len(sum))
+	for i, b := range sum {
+		hexSum[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexSum, ":")
+}
+
+// forgetServerCert removes any trusted certificate for host from serverCerts.
+func forgetServerCert(host string) bool {
+	found := false
+
+	muServerCerts.Lock()
+	certs := make([]serverCertificate, 0, len(serverCerts))
+	for _, c := range serverCerts {
+		if c.host == host {
+			found = true
+			continue
+		}
+		certs = append(certs, c)
+	}
+	serverCerts = certs
+	delete(pendingServerCerts, host)
+	delete(acceptedServerCerts, host)
+	serverCertsChanged = true
+	muServerCerts.Unlock()
+
+	return found
+}
+
+// generateClientCert creates a persistent client certificate for URL prefix u,
+// valid for the given number of days. keyType is "rsa" or "ed25519".
+func generateClientCert(u *url.URL, name string, keyType string, days int) (clientCertificate, error) {
+	var c clientCertificate
+	var err error
+
+	rsaBits := 0
+	switch keyType {
+	case "rsa":
+		rsaBits = 2048
+	case "ed25519":
+	default:
+		return c, fmt.Errorf("generateClientCert: unknown key type '%s'", keyType)
+	}
+	if days < 1 {
+		return c, fmt.Errorf("generateClientCert: certificate must be valid for at least one day")
+	}
+
+	c.URL = u.String()
+	c.Host = u.Host
+	c.Path = strings.Split(u.Path, "/")
+	expires := time.Now().Add(24 * time.Hour * time.Duration(days))
+	c.Cert, err = makeCert(time.Now(), expires, name, rsaBits)
+	if err != nil {
+		return c, fmt.Errorf("generateClientCert: %v", err)
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Cert.Certificate[0])
+	if err != nil {
+		return c, fmt.Errorf("generateClientCert: failed to parse new certificate: %v", err)
+	}
+	c.Expires = c.Leaf.NotAfter.String()
+	c.CertName = c.Leaf.Subject.CommonName
+
+	return c, err
+}
+
+// importServerCerts reads lines in the TOFU cache file format from rd,
+// and trusts the certificates they list. Returns the number imported.
+func importServerCerts(rd io.Reader) (int, error) {
+	imported := 0
+
+	scanner := bufio.NewScanner(rd)
+	muServerCerts.Lock()
+	defer muServerCerts.Unlock()
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		c, err := parseTOFULine(scanner.Text())
+		if err != nil {
+			return imported, fmt.Errorf("importServerCerts: %v", err)
+		}
+		pinServerCert(c, true)
+		imported++
+	}
+
+	return imported, scanner.Err()
+}
+
+// info returns the template-friendly description of the certificate.
+func (c serverCertificate) info() serverCertInfo {
+	return serverCertInfo{
+		Host:        c.host,
+		Fingerprint: c.fingerprint(),
+		Expires:     c.expires,
+		FirstSeen:   c.firstSeen,
+		LastSeen:    c.lastSeen,
+	}
+}
+
+// listClientCerts returns a copy of user's client certificates.
+func listClientCerts(user string) []clientCertificate {
+	muClientCerts.RLock()
+	defer muClientCerts.RUnlock()
+
+	certs := make([]clientCertificate, 0, len(clientCerts))
+	for _, c := range clientCerts {
+		if c.User == user {
+			certs = append(certs, c)
+		}
+	}
+	return certs
+}
+
+// listServerCerts returns descriptions of serverCerts, sorted by host.
+func listServerCerts() []serverCertInfo {
+	muServerCerts.RLock()
+	certs := make([]serverCertInfo, 0, len(serverCerts))
+	for _, c := range serverCerts {
+		certs = append(certs, c.info())
+	}
+	muServerCerts.RUnlock()
+
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Host < certs[j].Host })
+
+	return certs
+}
+
+// loadTransientClientCerts adds the unexpired transient client certificates
+// saved by saveTransientClientCerts to clientCerts.
+func loadTransientClientCerts() {
+	certsFile, err := configPath("transient-certs.json.enc")
+	if err != nil {
+		log.Println("loadTransientClientCerts:", err)
+		return
+	}
+	sealed, err := ioutil.ReadFile(certsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("loadTransientClientCerts: failed to read '%s': %v", certsFile, err)
+		}
+		return
+	}
+	jc, err := openTransientCerts(sealed)
+	if err != nil {
+		log.Printf("loadTransientClientCerts: failed to decrypt '%s' (did the key in --transientkey change?): %v", certsFile, err)
+		return
+	}
+	var pCerts []persistentCert
+	err = json.Unmarshal(jc, &pCerts)
+	if err != nil {
+		log.Printf("loadTransientClientCerts: failed to unmarshal JSON from '%s': %v", certsFile, err)
+		return
+	}
+
+	now := time.Now()
+	loaded := 0
+	muClientCerts.Lock()
+	for _, pc := range pCerts {
+		c, err := clientCertFromPEM(pc.URL, pc.CertPEM, pc.KeyPEM)
+		if err != nil {
+			log.Println("loadTransientClientCerts:", err)
+			continue
+		}
+		c.User = pc.User
+		if now.After(c.Leaf.NotAfter) {
+			continue
+		}
+		c.Transient = true
+		clientCerts = append(clientCerts, c)
+		loaded++
+	}
+	muClientCerts.Unlock()
+
+	if optLogLevel > 0 {
+		log.Printf("loadTransientClientCerts: loaded %d transient client certificates", loaded)
+	}
+}
+
 // makeCert returns a self-signed TLS certificate.
 // If rsaBits is less than 2048 (e.g., 0), makeCert returns an ed25519 certificate.
 func makeCert(starts time.Time, expires time.Time, name string, rsaBits int) (tls.Certificate, error) {
@@ -227,9 +589,10 @@ func makeCert(starts time.Time, expires time.Time, name string, rsaBits int) (tl
 	return tlsCert, err
 }
 
-// matchClientCert returns the TLS client certificate from clientCerts that
-// best matches URL u, or nil if none of the certificates match.
-func matchClientCert(u *url.URL) tls.Certificate {
+// matchClientCert returns the TLS client certificate of user from
+// clientCerts that best matches URL u, or nil if none of the certificates
+// match.
+func matchClientCert(u *url.URL, user string) tls.Certificate {
 	var matchingCert tls.Certificate
 	var bestMatchIndex int
 	var bestMatchScore int
@@ -237,13 +600,14 @@ func matchClientCert(u *url.URL) tls.Certificate {
 	splitPath := strings.Split(u.Path, "/")
 
 	muClientCerts.RLock()
+	defer muClientCerts.RUnlock()
 	for i, c := range clientCerts {
-		if u.Host != c.Host {
+		if u.Host != c.Host || c.User != user {
 			continue
 		}
 		score := 1
 		for i, p := range splitPath {
-			if p == c.Path[i] {
+			if i < len(c.Path) && p == c.Path[i] {
 				score++
 			}
 		}
@@ -264,11 +628,122 @@ func matchClientCert(u *url.URL) tls.Certificate {
 				strings.Join(clientCerts[bestMatchIndex].Path, "/"))
 		}
 	}
-	muClientCerts.RUnlock()
 
 	return matchingCert
 }
 
+// matchClientCertURL returns the URL of the client certificate that
+// matchClientCert would send to u for user, or an empty string if there is none.
+func matchClientCertURL(u *url.URL, user string) string {
+	cert := matchClientCert(u, user)
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	muClientCerts.RLock()
+	defer muClientCerts.RUnlock()
+	for _, c := range clientCerts {
+		if len(c.Cert.Certificate) > 0 && bytes.Equal(c.Cert.Certificate[0], cert.Certificate[0]) {
+			return c.URL
+		}
+	}
+
+	return ""
+}
+
+// openTransientCerts decrypts data sealed by sealTransientCerts.
+func openTransientCerts(sealed []byte) ([]byte, error) {
+	key, err := transientCertsKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("openTransientCerts: sealed data too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+// parseTOFULine parses one line of the TOFU cache file, in the form:
+//
+//	host expires cert [firstSeen lastSeen]
+//
+// Times are RFC3339. Lines written by older versions of Gneto lack the
+// first and last seen times.
+func parseTOFULine(line string) (serverCertificate, error) {
+	var c serverCertificate
+	var err error
+
+	split := strings.Fields(line)
+	if len(split) != 3 && len(split) != 5 {
+		return c, fmt.Errorf("parseTOFULine: expected 3 or 5 fields, found %d", len(split))
+	}
+	c.host = split[0]
+	c.cert = split[2]
+	c.expires, err = time.Parse(time.RFC3339, split[1])
+	if err != nil {
+		return c, fmt.Errorf("parseTOFULine: bad expiry time for %s: %v", c.host, err)
+	}
+	if len(split) == 5 {
+		c.firstSeen, err = time.Parse(time.RFC3339, split[3])
+		if err != nil {
+			return c, fmt.Errorf("parseTOFULine: bad first seen time for %s: %v", c.host, err)
+		}
+		c.lastSeen, err = time.Parse(time.RFC3339, split[4])
+		if err != nil {
+			return c, fmt.Errorf("parseTOFULine: bad last seen time for %s: %v", c.host, err)
+		}
+	}
+
+	return c, err
+}
+
+// persistentCert returns c in the form we store in JSON files.
+func (c clientCertificate) persistentCert() (persistentCert, error) {
+	var pc persistentCert
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.Cert.PrivateKey)
+	if err != nil {
+		return pc, fmt.Errorf("persistentCert: failed to marshal private key for %s: %v", c.URL, err)
+	}
+	pc.URL = c.URL
+	pc.User = c.User
+	pc.CertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Certificate[0]}))
+	pc.KeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+
+	return pc, err
+}
+
+// pinServerCert adds c to serverCerts. If serverCerts already holds a
+// certificate for the same host, replace controls whether c supersedes it.
+// The caller must hold muServerCerts.
+func pinServerCert(c serverCertificate, replace bool) {
+	for i, old := range serverCerts {
+		if old.host != c.host {
+			continue
+		}
+		if replace {
+			if old.cert == c.cert || c.firstSeen.IsZero() {
+				c.firstSeen = old.firstSeen
+			}
+			serverCerts[i] = c
+			serverCertsChanged = true
+		}
+		return
+	}
+	serverCerts = append(serverCerts, c)
+	serverCertsChanged = true
+}
+
 func publicKey(priv interface{}) interface{} {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
@@ -289,17 +764,20 @@ func purgeOldClientCertificates() {
 		muClientCerts.Lock()
 		freshCerts := make([]clientCertificate, 0, len(clientCerts))
 		for _, c := range clientCerts {
-			if optClientCertsFile != "" && c.Cert.Leaf == nil {
+			if !c.Transient {
 				freshCerts = append(freshCerts, c)
 				continue
 			}
-			if now.Before(c.Cert.Leaf.NotAfter) {
+			if now.Before(c.Leaf.NotAfter) {
 				freshCerts = append(freshCerts, c)
 			} else {
 				expired++
 			}
 		}
 		clientCerts = freshCerts
+		if expired > 0 {
+			clientCertsChanged = true
+		}
 		muClientCerts.Unlock()
 
 		if optLogLevel > 1 {
@@ -310,8 +788,53 @@ func purgeOldClientCertificates() {
 	}
 }
 
-// saveClientCert adds a TLS client certificate to clientCerts.
-func saveClientCert(u *url.URL, name string) {
+// rejectServerCert discards a pending certificate mismatch for host.
+func rejectServerCert(host string) {
+	muServerCerts.Lock()
+	delete(pendingServerCerts, host)
+	muServerCerts.Unlock()
+}
+
+// repinServerCert connects to host, and trusts whatever certificate it sends,
+// replacing any certificate we trusted for it before.
+func repinServerCert(host string) error {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "1965")
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return fmt.Errorf("repinServerCert: failed to connect to %s: %v", host, err)
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	pc := serverCertificate{
+		host:      host,
+		expires:   conn.ConnectionState().PeerCertificates[0].NotAfter,
+		cert:      base64.StdEncoding.EncodeToString(conn.ConnectionState().PeerCertificates[0].Raw),
+		firstSeen: now,
+		lastSeen:  now,
+	}
+
+	muServerCerts.Lock()
+	delete(pendingServerCerts, host)
+	pinServerCert(pc, true)
+	muServerCerts.Unlock()
+
+	if optLogLevel > 0 {
+		log.Printf("repinServerCert: now trusting certificate %s for %s", pc.fingerprint(), host)
+	}
+
+	return err
+}
+
+// saveClientCert adds a transient TLS client certificate for user to clientCerts.
+func saveClientCert(u *url.URL, name string, user string) {
 	var err error
 	var newCert clientCertificate
 
@@ -327,12 +850,58 @@ func saveClientCert(u *url.URL, name string) {
 	}
 	newCert.Leaf, err = x509.ParseCertificate(newCert.Cert.Certificate[0])
 	newCert.CertName = newCert.Leaf.Subject.CommonName
+	newCert.Transient = true
+	newCert.User = user
 
 	muClientCerts.Lock()
 	clientCerts = append(clientCerts, newCert)
+	clientCertsChanged = true
 	muClientCerts.Unlock()
 }
 
+// saveClientCertsFile writes the persistent client certificates to the
+// --clientcerts JSON file, or, if that's unset, to our config directory.
+func saveClientCertsFile() error {
+	var err error
+	muClientCertsFile.Lock()
+	defer muClientCertsFile.Unlock()
+
+	if optClientCertsFile == "" {
+		optClientCertsFile, err = configPath("client-certs.json")
+		if err != nil {
+			return fmt.Errorf("saveClientCertsFile: %v", err)
+		}
+		log.Printf("saveClientCertsFile: saving persistent client certificates to '%s'", optClientCertsFile)
+	}
+
+	muClientCerts.RLock()
+	pCerts := make([]persistentCert, 0, len(clientCerts))
+	for _, c := range clientCerts {
+		if c.Transient {
+			continue
+		}
+		pc, err := c.persistentCert()
+		if err != nil {
+			muClientCerts.RUnlock()
+			return fmt.Errorf("saveClientCertsFile: %v", err)
+		}
+		pCerts = append(pCerts, pc)
+	}
+	muClientCerts.RUnlock()
+
+	jc, err := json.MarshalIndent(pCerts, "", "\t")
+	if err != nil {
+		return fmt.Errorf("saveClientCertsFile: failed to marshal JSON: %v", err)
+	}
+	tmpFile := optClientCertsFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, jc, 0600)
+	if err != nil {
+		return fmt.Errorf("saveClientCertsFile: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, optClientCertsFile)
+}
+
 // saveTOFU saves known TLS server certificates to a file.
 func saveTOFU() {
 	d, err := os.UserCacheDir()
@@ -349,16 +918,12 @@ func saveTOFU() {
 	scanner := bufio.NewScanner(f)
 	muServerCerts.Lock()
 	for scanner.Scan() {
-		split := strings.Split(scanner.Text(), " ")
-		exp, err := time.Parse(time.RFC3339, split[1])
-		if len(split) == 3 && err == nil {
-			c := serverCertificate{
-				host:    split[0],
-				expires: exp,
-				cert:    split[2],
-			}
-			serverCerts = append(serverCerts, c)
+		c, err := parseTOFULine(scanner.Text())
+		if err != nil {
+			log.Printf("saveTOFU: skipping line in '%s': %v", tofuFile, err)
+			continue
 		}
+		pinServerCert(c, false)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("saveTOFU: failed reading line from '%s': %v", tofuFile, err)
@@ -379,6 +944,7 @@ func saveTOFU() {
 				certs = append(certs, c)
 			}
 			serverCerts = certs
+			serverCertsChanged = false
 			muServerCerts.Unlock()
 
 			f, err := os.Create(tofuFile)
@@ -392,14 +958,153 @@ func saveTOFU() {
 				}
 				continue
 			}
-			muServerCerts.RLock()
-			for _, c := range serverCerts {
-				fmt.Fprintf(f, "%s %s %s\n", c.host, c.expires.Format(time.RFC3339), c.cert)
+			err = exportServerCerts(f)
+			if err != nil {
+				log.Printf("saveTOFU: failed to write TOFU cache file '%s': %v", tofuFile, err)
 			}
-			muServerCerts.RUnlock()
 			f.Close()
 		}
 
 		time.Sleep(10 * time.Minute)
 	}
 }
+
+// saveTransientClientCerts saves transient client certificates, encrypted,
+// to a file whenever they change.
+func saveTransientClientCerts() {
+	certsFile, err := configPath("transient-certs.json.enc")
+	if err != nil {
+		log.Println("saveTransientClientCerts: transient client certificates will not be saved:", err)
+		return
+	}
+
+	for {
+		muClientCerts.Lock()
+		changed := clientCertsChanged
+		clientCertsChanged = false
+		pCerts := make([]persistentCert, 0, len(clientCerts))
+		if changed {
+			for _, c := range clientCerts {
+				if !c.Transient {
+					continue
+				}
+				pc, err := c.persistentCert()
+				if err != nil {
+					log.Println("saveTransientClientCerts:", err)
+					continue
+				}
+				pCerts = append(pCerts, pc)
+			}
+		}
+		muClientCerts.Unlock()
+
+		if changed {
+			err = writeTransientCerts(certsFile, pCerts)
+			if err != nil {
+				log.Println("saveTransientClientCerts:", err)
+				muClientCerts.Lock()
+				clientCertsChanged = true
+				muClientCerts.Unlock()
+			} else if optLogLevel > 1 {
+				log.Printf("saveTransientClientCerts: saved %d transient client certificates", len(pCerts))
+			}
+		}
+
+		time.Sleep(time.Minute)
+	}
+}
+
+// sealTransientCerts encrypts plaintext with AES-GCM. The result holds the
+// nonce, then the ciphertext.
+func sealTransientCerts(plaintext []byte) ([]byte, error) {
+	key, err := transientCertsKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// tofuLine returns the certificate as a line of the TOFU cache file.
+func (c serverCertificate) tofuLine() string {
+	return fmt.Sprintf("%s %s %s %s %s\n", c.host, c.expires.Format(time.RFC3339), c.cert,
+		c.firstSeen.Format(time.RFC3339), c.lastSeen.Format(time.RFC3339))
+}
+
+// transientCertsKey returns the AES key that encrypts transient client
+// certificates at rest, creating it if need be. The key lives in the
+// --transientkey file, which anyone who can read it could use to decrypt
+// the certificates.
+func transientCertsKey() ([]byte, error) {
+	keyFile := optTransientKeyFile
+	if keyFile == "" {
+		var err error
+		keyFile, err = configPath("transient-certs.key")
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		// Never replace a key we can't use, or the certificates it
+		// encrypted are lost.
+		if len(key) != 32 {
+			return nil, fmt.Errorf("transientCertsKey: key file '%s' is %d bytes, want 32", keyFile, len(key))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("transientCertsKey: failed to read key file '%s': %v", keyFile, err)
+	}
+
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("transientCertsKey: failed to generate key: %v", err)
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("transientCertsKey: failed to create key file '%s': %v", keyFile, err)
+	}
+	_, err = f.Write(key)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transientCertsKey: failed to write key file '%s': %v", keyFile, err)
+	}
+
+	return key, nil
+}
+
+// writeTransientCerts encrypts pCerts, and writes them to certsFile.
+func writeTransientCerts(certsFile string, pCerts []persistentCert) error {
+	jc, err := json.Marshal(pCerts)
+	if err != nil {
+		return fmt.Errorf("writeTransientCerts: failed to marshal JSON: %v", err)
+	}
+	sealed, err := sealTransientCerts(jc)
+	if err != nil {
+		return fmt.Errorf("writeTransientCerts: failed to encrypt: %v", err)
+	}
+	tmpFile := certsFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, sealed, 0600)
+	if err != nil {
+		return fmt.Errorf("writeTransientCerts: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, certsFile)
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTransientKeyFile points --transientkey at a new file in a temporary
+// directory for the rest of the test.
+func useTransientKeyFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gneto-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := optTransientKeyFile
+	optTransientKeyFile = filepath.Join(dir, "transient-certs.key")
+	t.Cleanup(func() {
+		optTransientKeyFile = old
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestTransientCertsRoundTrip(t *testing.T) {
+	dir := useTransientKeyFile(t)
+
+	u, err := url.Parse("gemini://example.com/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pCerts []persistentCert
+	for _, keyType := range []string{"ed25519", "rsa"} {
+		c, err := generateClientCert(u, "transient", keyType, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.User = "alice"
+		pc, err := c.persistentCert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pCerts = append(pCerts, pc)
+	}
+
+	certsFile := filepath.Join(dir, "transient-certs.json.enc")
+	err = writeTransientCerts(certsFile, pCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadFile(certsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("PRIVATE KEY")) || bytes.Contains(sealed, []byte("example.com")) {
+		t.Error("transient certificates saved in the clear")
+	}
+
+	jc, err := openTransientCerts(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []persistentCert
+	err = json.Unmarshal(jc, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pCerts) {
+		t.Fatalf("got %d certificates, want %d", len(got), len(pCerts))
+	}
+	for i := range pCerts {
+		if got[i] != pCerts[i] {
+			t.Errorf("certificate %d changed in the round trip", i)
+		}
+		if _, err := clientCertFromPEM(got[i].URL, got[i].CertPEM, got[i].KeyPEM); err != nil {
+			t.Errorf("certificate %d: %v", i, err)
+		}
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := openTransientCerts(tampered); err == nil {
+		t.Error("openTransientCerts of tampered data succeeded")
+	}
+	if _, err := openTransientCerts(sealed[:4]); err == nil {
+		t.Error("openTransientCerts of truncated data succeeded")
+	}
+
+	// A new key can't open what the old one sealed.
+	err = os.Remove(optTransientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openTransientCerts(sealed); err == nil {
+		t.Error("openTransientCerts with a new key succeeded")
+	}
+}
+
+func TestTransientCertsKeyWrongLength(t *testing.T) {
+	useTransientKeyFile(t)
+
+	bad := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	err := ioutil.WriteFile(optTransientKeyFile, bad, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transientCertsKey(); err == nil {
+		t.Error("transientCertsKey accepted a 64-byte key file")
+	}
+	b, err := ioutil.ReadFile(optTransientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, bad) {
+		t.Error("transientCertsKey overwrote a key file it couldn't use")
+	}
+}
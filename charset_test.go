@@ -0,0 +1,71 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		meta        string
+		in          string
+		want        string
+		wantCharset string
+		wantOK      bool
+	}{
+		{"text/gemini", "caf\xc3\xa9", "café", "utf-8", true},
+		{"text/gemini; charset=UTF-8", "caf\xc3\xa9", "café", "UTF-8", true},
+		{"text/gemini; charset=iso-8859-1", "caf\xe9", "café", "iso-8859-1", true},
+		{"text/plain; charset=\"latin1\"", "\xa3\xff", "£ÿ", "latin1", true},
+		{"text/plain; CHARSET=ISO-8859-1", "caf\xe9", "café", "ISO-8859-1", true},
+		{"text/plain; charset=windows-1252", "\x93quoted\x94 \x80", "“quoted” €", "windows-1252", true},
+		{"text/plain; charset=ISO-8859-15", "\xa4", "€", "ISO-8859-15", true},
+		{"text/gemini; charset=koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет", "koi8-r", true},
+		{"text/gemini; charset=windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет", "windows-1251", true},
+		{"text/gemini; charset=iso-8859-7", "\xc1\xe8\xde\xed\xe1", "Αθήνα", "iso-8859-7", true},
+		{"text/gemini; lang=en; charset=us-ascii", "plain", "plain", "us-ascii", true},
+		{"text/gemini; charset=shift_jis", "\x82\xa0", "\x82\xa0", "shift_jis", false},
+	}
+
+	for _, tt := range tests {
+		rd, charset, ok := decodeText(bufio.NewReader(strings.NewReader(tt.in)), tt.meta)
+		if charset != tt.wantCharset || ok != tt.wantOK {
+			t.Errorf("decodeText(%q) charset %q, %v, want %q, %v", tt.meta, charset, ok, tt.wantCharset, tt.wantOK)
+			continue
+		}
+		b, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Errorf("decodeText(%q): %v", tt.meta, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("decodeText(%q) = %q, want %q", tt.meta, b, tt.want)
+		}
+	}
+}
+
+func TestCharsetReaderSmallReads(t *testing.T) {
+	in := strings.Repeat("caf\xe9 ", 1000)
+	rd, _, ok := decodeText(bufio.NewReaderSize(strings.NewReader(in), 16), "text/plain; charset=iso-8859-1")
+	if !ok {
+		t.Fatal("decodeText: can't convert iso-8859-1")
+	}
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := rd.Read(buf)
+		sb.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	if want := strings.Repeat("café ", 1000); sb.String() != want {
+		t.Errorf("read %d bytes, want %d", sb.Len(), len(want))
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// configAliases maps friendlier config file keys to the names of our flags.
+var configAliases = map[string]string{
+	"redirects": "r",
+}
+
+// readConfig reads the config file at configFile. Each non-blank line holds
+// an option, like:
+//
+//	port = 8065
+//	textonly = true
+//
+// Option names are the same as the command-line flags. Lines starting with
+// "#" or ";" are comments, and "[section]" lines are ignored.
+func readConfig(configFile string) (map[string]string, error) {
+	cfg := make(map[string]string)
+
+	f, err := os.Open(configFile)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return cfg, fmt.Errorf("readConfig: line %d of '%s' is not a 'key = value' pair", n, configFile)
+		}
+		key := strings.ToLower(strings.TrimSpace(split[0]))
+		if alias, ok := configAliases[key]; ok {
+			key = alias
+		}
+		cfg[key] = strings.Trim(strings.TrimSpace(split[1]), `"'`)
+	}
+
+	return cfg, scanner.Err()
+}
+
+// reloadableOptions are the options that reloadConfig changes while we run.
+// The rest take effect only after a restart. Read them with boolOption,
+// intOption, or stringOption.
+var reloadableOptions = map[string]bool{
+	"collapsepre": true,
+	"css":         true,
+	"home":        true,
+	"images":      true,
+	"lang":        true,
+	"password":    true,
+	"r":           true,
+	"robots":      true,
+	"textonly":    true,
+}
+
+// configFilePath returns the path of our config file, or "" if there is
+// none.
+func configFilePath() string {
+	if optConfigFile != "" {
+		return optConfigFile
+	}
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	configFile := path.Join(d, "gneto", "config")
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		return ""
+	}
+	return configFile
+}
+
+// loadConfig reads the config file, and applies every option in it that
+// wasn't set on the command line. The 'password' option applies only if the
+// 'password' environment variable is unset.
+func loadConfig() error {
+	configFile := configFilePath()
+	if configFile == "" {
+		return nil
+	}
+
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("loadConfig: failed to read config file: %v", err)
+	}
+
+	for key, value := range cfg {
+		if key == "password" {
+			if _, ok := os.LookupEnv("password"); !ok {
+				envPassword = value
+			}
+			continue
+		}
+		if cmdLineOpts[key] {
+			continue
+		}
+		if key == "config" || flag.Lookup(key) == nil {
+			log.Printf("loadConfig: ignoring unknown option '%s' in '%s'", key, configFile)
+			continue
+		}
+		err = flag.Set(key, value)
+		if err != nil {
+			return fmt.Errorf("loadConfig: bad value for '%s' in '%s': %v", key, configFile, err)
+		}
+	}
+	configValues = cfg
+
+	if optLogLevel > 0 {
+		log.Printf("loadConfig: read %d options from '%s'", len(cfg), configFile)
+	}
+
+	return err
+}
+
+// reloadConfig rereads the config file whenever we get a SIGHUP, and applies
+// the reloadable options in it that weren't set on the command line.
+// Reloadable options removed from the file go back to their defaults.
+// Sessions survive the reload.
+func reloadConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		configFile := configFilePath()
+		cfg := make(map[string]string)
+		if configFile != "" {
+			var err error
+			cfg, err = readConfig(configFile)
+			if err != nil {
+				log.Println("reloadConfig: failed to read config file:", err)
+				continue
+			}
+		}
+
+		keys := make(map[string]bool)
+		for key := range cfg {
+			keys[key] = true
+		}
+		for key := range configValues {
+			keys[key] = true
+		}
+
+		var restart []string
+		muOptions.Lock()
+		for key := range keys {
+			value, ok := cfg[key]
+			oldValue, wasSet := configValues[key]
+			if cmdLineOpts[key] || key == "config" || (key != "password" && flag.Lookup(key) == nil) {
+				continue
+			}
+			if !reloadableOptions[key] {
+				if ok != wasSet || value != oldValue {
+					restart = append(restart, key)
+				}
+				continue
+			}
+			if key == "password" {
+				if _, env := os.LookupEnv("password"); !env {
+					envPassword = value
+				}
+				continue
+			}
+			if !ok {
+				value = flag.Lookup(key).DefValue
+			}
+			err := flag.Set(key, value)
+			if err != nil {
+				log.Printf("reloadConfig: bad value for '%s' in '%s': %v", key, configFile, err)
+			}
+		}
+		muOptions.Unlock()
+		configValues = cfg
+
+		log.Println("reloadConfig: reloaded configuration")
+		if len(restart) > 0 {
+			sort.Strings(restart)
+			log.Printf("reloadConfig: restart Gneto to apply changes to %s", strings.Join(restart, ", "))
+		}
+	}
+}
+
+// boolOption returns the value of the reloadable option at p.
+func boolOption(p *bool) bool {
+	muOptions.RLock()
+	defer muOptions.RUnlock()
+	return *p
+}
+
+// intOption returns the value of the reloadable option at p.
+func intOption(p *int) int {
+	muOptions.RLock()
+	defer muOptions.RUnlock()
+	return *p
+}
+
+// stringOption returns the value of the reloadable option at p.
+func stringOption(p *string) string {
+	muOptions.RLock()
+	defer muOptions.RUnlock()
+	return *p
+}
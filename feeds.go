@@ -0,0 +1,408 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We keep no more than this many entries for each subscription.
+const maxFeedEntries = 100
+
+// reGemfeedDate matches the date that starts the label of each post's
+// link in a gemfeed (gemini://gemini.circumlunar.space/docs/companion/subscription.gmi).
+var reGemfeedDate = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})[\s:-]*(.*)$`)
+
+// feedEntry is one post in a feed.
+type feedEntry struct {
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Published time.Time `json:"published"`
+	Read      bool      `json:"read"`
+	FeedTitle string    `json:"-"`
+	FeedURL   string    `json:"-"`
+}
+
+// subscription is a gemlog or Atom feed we poll for new posts.
+type subscription struct {
+	URL     string      `json:"url"`
+	Title   string      `json:"title"`
+	Fetched time.Time   `json:"fetched"`
+	Error   string      `json:"error,omitempty"`
+	Entries []feedEntry `json:"entries"`
+}
+
+// feedStore keeps our subscriptions, and the entries we've seen in them,
+// in a JSON file.
+type feedStore struct {
+	mu            sync.Mutex
+	saveMu        sync.Mutex
+	file          string
+	user          string
+	subscriptions []subscription
+	changed       bool
+}
+
+// Unread returns how many of s's entries we haven't read.
+func (s subscription) Unread() int {
+	n := 0
+	for _, e := range s.Entries {
+		if !e.Read {
+			n++
+		}
+	}
+	return n
+}
+
+// atomFeed is the part of an Atom (RFC 4287) feed we use.
+type atomFeed struct {
+	Title   string `xml:"title"`
+	Entries []struct {
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// newFeedStore returns the subscriptions in file, which need not exist yet.
+// We fetch the feeds with user's client certificates.
+func newFeedStore(file string, user string) (*feedStore, error) {
+	fs := &feedStore{file: file, user: user}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return fs, fmt.Errorf("newFeedStore: failed to read '%s': %v", file, err)
+	}
+	err = json.Unmarshal(b, &fs.subscriptions)
+	if err != nil {
+		return fs, fmt.Errorf("newFeedStore: failed to unmarshal JSON from '%s': %v", file, err)
+	}
+
+	return fs, err
+}
+
+// entries returns the entries of every subscription, newest first.
+func (fs *feedStore) entries() []feedEntry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var entries []feedEntry
+	for _, s := range fs.subscriptions {
+		for _, e := range s.Entries {
+			e.FeedTitle = s.Title
+			e.FeedURL = s.URL
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Published.After(entries[j].Published)
+	})
+
+	return entries
+}
+
+// list returns a copy of the subscriptions, without their entries.
+func (fs *feedStore) list() []subscription {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	subs := make([]subscription, 0, len(fs.subscriptions))
+	for _, s := range fs.subscriptions {
+		s.Entries = append([]feedEntry{}, s.Entries...)
+		subs = append(subs, s)
+	}
+	return subs
+}
+
+// markRead marks the entry for rawURL read, or, if rawURL is empty, every
+// entry of the subscription for feedURL, or, if that's empty too, every entry.
+func (fs *feedStore) markRead(rawURL, feedURL string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := range fs.subscriptions {
+		if feedURL != "" && fs.subscriptions[i].URL != feedURL {
+			continue
+		}
+		for j := range fs.subscriptions[i].Entries {
+			e := &fs.subscriptions[i].Entries[j]
+			if (rawURL == "" || e.URL == rawURL) && !e.Read {
+				e.Read = true
+				fs.changed = true
+			}
+		}
+	}
+}
+
+// poll fetches every subscription last fetched more than --feedinterval
+// minutes ago, or, if force is true, every subscription.
+func (fs *feedStore) poll(force bool) {
+	fs.mu.Lock()
+	var due []string
+	for _, s := range fs.subscriptions {
+		if force || time.Since(s.Fetched) >= time.Duration(optFeedInterval)*time.Minute {
+			due = append(due, s.URL)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, rawURL := range due {
+		fs.fetch(rawURL)
+	}
+}
+
+// fetch fetches the feed at rawURL, and updates its subscription. Since
+// pollFeeds runs it in the background, it recovers from panics, so one bad
+// feed can't take down the server.
+func (fs *feedStore) fetch(rawURL string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("feedStore: panic fetching %s: %v\n%s", rawURL, r, debug.Stack())
+			fs.update(rawURL, "", nil, fmt.Errorf("feedStore: failed to fetch %s: %v", rawURL, r))
+		}
+	}()
+
+	title, entries, err := fetchFeed(rawURL, fs.user)
+	if err != nil && optLogLevel > 0 {
+		log.Printf("feedStore: failed to fetch %s: %v", rawURL, err)
+	}
+	fs.update(rawURL, title, entries, err)
+}
+
+// remove unsubscribes from the feed at rawURL.
+func (fs *feedStore) remove(rawURL string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i, s := range fs.subscriptions {
+		if s.URL == rawURL {
+			fs.subscriptions = append(fs.subscriptions[:i], fs.subscriptions[i+1:]...)
+			fs.changed = true
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the subscriptions to their file, if anything changed.
+func (fs *feedStore) save() error {
+	fs.saveMu.Lock()
+	defer fs.saveMu.Unlock()
+
+	fs.mu.Lock()
+	if !fs.changed {
+		fs.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(fs.subscriptions, "", "\t")
+	fs.changed = false
+	fs.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("feedStore: failed to marshal JSON: %v", err)
+	}
+
+	tmpFile := fs.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0600)
+	if err != nil {
+		return fmt.Errorf("feedStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, fs.file)
+}
+
+// subscribe adds a subscription to the feed at rawURL, and fetches it.
+func (fs *feedStore) subscribe(rawURL string) error {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Scheme != "gemini" || u.Host == "" {
+		return fmt.Errorf("feedStore: not a gemini:// URL: '%s'", rawURL)
+	}
+	u.Fragment = ""
+	rawURL = u.String()
+
+	fs.mu.Lock()
+	for _, s := range fs.subscriptions {
+		if s.URL == rawURL {
+			fs.mu.Unlock()
+			return fmt.Errorf("feedStore: already subscribed to %s", rawURL)
+		}
+	}
+	fs.subscriptions = append(fs.subscriptions, subscription{URL: rawURL, Title: rawURL})
+	fs.changed = true
+	fs.mu.Unlock()
+
+	title, entries, err := fetchFeed(rawURL, fs.user)
+	fs.update(rawURL, title, entries, err)
+
+	return err
+}
+
+// update merges newly fetched entries into the subscription for rawURL,
+// keeping what we knew about entries we'd already seen.
+func (fs *feedStore) update(rawURL, title string, entries []feedEntry, fetchErr error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := range fs.subscriptions {
+		s := &fs.subscriptions[i]
+		if s.URL != rawURL {
+			continue
+		}
+		s.Fetched = time.Now()
+		fs.changed = true
+		if fetchErr != nil {
+			s.Error = fetchErr.Error()
+			return
+		}
+		s.Error = ""
+		if title != "" {
+			s.Title = title
+		}
+
+		read := make(map[string]bool)
+		for _, e := range s.Entries {
+			read[e.URL] = e.Read
+		}
+		for j := range entries {
+			entries[j].Read = read[entries[j].URL]
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Published.After(entries[j].Published)
+		})
+		if len(entries) > maxFeedEntries {
+			entries = entries[:maxFeedEntries]
+		}
+		s.Entries = entries
+		return
+	}
+}
+
+// fetchFeed fetches the gemfeed or Atom feed at rawURL, with user's client
+// certificate, if any, and returns its title and entries.
+func fetchFeed(rawURL string, user string) (string, []feedEntry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	meta, body, err := fetchGemini(u, user, optMaxGemtext)
+	if err != nil {
+		return "", nil, err
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if strings.Contains(meta, "xml") || bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<feed")) {
+		return parseAtomFeed(u, body)
+	}
+	if meta != "" && !strings.HasPrefix(meta, "text/gemini") {
+		return "", nil, fmt.Errorf("fetchFeed: %s is %s, not a gemfeed or Atom feed", rawURL, meta)
+	}
+
+	doc, err := parseGemini(bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	return documentTitle(doc), parseGemfeed(u, doc), err
+}
+
+// parseAtomFeed returns the title and entries of the Atom feed in body,
+// resolving relative links against u.
+func parseAtomFeed(u *url.URL, body []byte) (string, []feedEntry, error) {
+	var af atomFeed
+	err := xml.Unmarshal(body, &af)
+	if err != nil {
+		return "", nil, fmt.Errorf("parseAtomFeed: failed to parse %s: %v", u.String(), err)
+	}
+
+	var entries []feedEntry
+	for _, ae := range af.Entries {
+		var href string
+		for _, l := range ae.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				href = l.Href
+				break
+			}
+		}
+		lu, err := absoluteURL(u, strings.TrimSpace(href))
+		if href == "" || err != nil {
+			continue
+		}
+		published, err := time.Parse(time.RFC3339, strings.TrimSpace(ae.Published))
+		if err != nil {
+			published, _ = time.Parse(time.RFC3339, strings.TrimSpace(ae.Updated))
+		}
+		entries = append(entries, feedEntry{
+			URL:       lu.String(),
+			Title:     strings.Join(strings.Fields(ae.Title), " "),
+			Published: published,
+		})
+	}
+
+	return strings.Join(strings.Fields(af.Title), " "), entries, err
+}
+
+// parseGemfeed returns the entries of the gemfeed in doc: the links whose
+// labels start with a date, resolved against u.
+func parseGemfeed(u *url.URL, doc gemDocument) []feedEntry {
+	var entries []feedEntry
+	for _, l := range doc.Lines {
+		if l.Type != gemLink {
+			continue
+		}
+		m := reGemfeedDate.FindStringSubmatch(l.Text)
+		if m == nil {
+			continue
+		}
+		published, err := time.Parse("2006-01-02", m[1])
+		if err != nil {
+			continue
+		}
+		lu, err := absoluteURL(u, l.URL)
+		if err != nil {
+			continue
+		}
+		title := m[2]
+		if title == "" {
+			title = lu.String()
+		}
+		entries = append(entries, feedEntry{URL: lu.String(), Title: title, Published: published})
+	}
+	return entries
+}
+
+// pollFeeds periodically fetches every user's subscriptions, and saves them.
+func pollFeeds() {
+	for {
+		for _, p := range loadedProfiles() {
+			if p.feeds == nil {
+				continue
+			}
+			p.feeds.poll(false)
+			err := p.feeds.save()
+			if err != nil {
+				log.Println("pollFeeds:", err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
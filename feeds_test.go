@@ -0,0 +1,114 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseGemfeed(t *testing.T) {
+	u, err := url.Parse("gemini://example.com/gemlog/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := parseGemini(strings.NewReader(`# My Gemlog
+Some text.
+=> 2024-03-01 - First post
+=> post1.gmi 2024-03-01 - First post
+=> /gemlog/post2.gmi 2024-03-15: Second post
+=> gemini://other.example/post3.gmi 2024-04-01 Third post
+=> post4.gmi 2024-05-01
+=> about.gmi About me
+=> post5.gmi 2024-13-40 Bad date
+* 2024-06-01 not a link
+` + "```\n=> post6.gmi 2024-07-01 Preformatted\n```\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []feedEntry{
+		{URL: "gemini://example.com/gemlog/post1.gmi", Title: "First post", Published: date("2024-03-01T00:00:00Z")},
+		{URL: "gemini://example.com/gemlog/post2.gmi", Title: "Second post", Published: date("2024-03-15T00:00:00Z")},
+		{URL: "gemini://other.example/post3.gmi", Title: "Third post", Published: date("2024-04-01T00:00:00Z")},
+		{URL: "gemini://example.com/gemlog/post4.gmi", Title: "gemini://example.com/gemlog/post4.gmi", Published: date("2024-05-01T00:00:00Z")},
+	}
+	got := parseGemfeed(u, doc)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseAtomFeed(t *testing.T) {
+	u, err := url.Parse("gemini://example.com/atom.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>  Example
+    Feed </title>
+  <entry>
+    <title>Published</title>
+    <link href="gemlog/one.gmi"/>
+    <published>2024-03-01T10:00:00Z</published>
+    <updated>2024-03-02T10:00:00Z</updated>
+  </entry>
+  <entry>
+    <title>Only updated</title>
+    <link rel="alternate" href=" gemini://example.com/two.gmi "/>
+    <updated>2024-03-05T08:30:00+02:00</updated>
+  </entry>
+  <entry>
+    <title>Skips other rels</title>
+    <link rel="self" href="self.xml"/>
+    <link rel="alternate" href="three.gmi"/>
+  </entry>
+  <entry>
+    <title>No link</title>
+    <link rel="enclosure" href="four.mp3"/>
+  </entry>
+</feed>`)
+
+	title, entries, err := parseAtomFeed(u, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Example Feed" {
+		t.Errorf("title = %q, want %q", title, "Example Feed")
+	}
+	want := []feedEntry{
+		{URL: "gemini://example.com/gemlog/one.gmi", Title: "Published", Published: date("2024-03-01T10:00:00Z")},
+		{URL: "gemini://example.com/two.gmi", Title: "Only updated", Published: date("2024-03-05T08:30:00+02:00")},
+		{URL: "gemini://example.com/three.gmi", Title: "Skips other rels"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries %+v, want %d", len(entries), entries, len(want))
+	}
+	for i := range want {
+		if entries[i].URL != want[i].URL || entries[i].Title != want[i].Title || !entries[i].Published.Equal(want[i].Published) {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	if _, _, err := parseAtomFeed(u, []byte("<feed><entry>")); err == nil {
+		t.Error("parseAtomFeed of truncated XML succeeded")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// feedToken lets a feed reader, which can't log in, fetch /feed as a user.
+// Like sessions, we keep only a hash of the token.
+type feedToken struct {
+	Hash    string    `json:"hash"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+// feedTokenStore keeps each user's feed token in a JSON file.
+type feedTokenStore struct {
+	mu     sync.Mutex
+	saveMu sync.Mutex
+	file   string
+	tokens []feedToken
+}
+
+// newFeedTokenStore returns the feed tokens in file, which need not exist yet.
+func newFeedTokenStore(file string) (*feedTokenStore, error) {
+	ts := &feedTokenStore{file: file}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return ts, fmt.Errorf("newFeedTokenStore: failed to read '%s': %v", file, err)
+	}
+	err = json.Unmarshal(b, &ts.tokens)
+	if err != nil {
+		return ts, fmt.Errorf("newFeedTokenStore: failed to unmarshal JSON from '%s': %v", file, err)
+	}
+
+	return ts, err
+}
+
+// create makes a new feed token for user, replacing any they had, saves
+// the tokens, and returns the new token.
+func (ts *feedTokenStore) create(user string) (string, error) {
+	b := make([]byte, 32)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("feedTokenStore: failed to generate token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	ts.mu.Lock()
+	ts.remove(user)
+	ts.tokens = append(ts.tokens, feedToken{Hash: hashToken(token), User: user, Created: time.Now()})
+	ts.mu.Unlock()
+
+	return token, ts.save()
+}
+
+// created returns when user made their feed token, or the zero time if
+// they have none.
+func (ts *feedTokenStore) created(user string) time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, t := range ts.tokens {
+		if t.User == user {
+			return t.Created
+		}
+	}
+	return time.Time{}
+}
+
+// find returns the user whose feed token is token.
+func (ts *feedTokenStore) find(token string) (string, bool) {
+	hash := hashToken(token)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, t := range ts.tokens {
+		if t.Hash == hash {
+			return t.User, true
+		}
+	}
+	return "", false
+}
+
+// remove forgets user's feed token. The caller must hold ts.mu.
+func (ts *feedTokenStore) remove(user string) bool {
+	for i, t := range ts.tokens {
+		if t.User == user {
+			ts.tokens = append(ts.tokens[:i], ts.tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// revoke forgets user's feed token, and saves the tokens.
+func (ts *feedTokenStore) revoke(user string) error {
+	ts.mu.Lock()
+	removed := ts.remove(user)
+	ts.mu.Unlock()
+	if !removed {
+		return nil
+	}
+
+	return ts.save()
+}
+
+// save writes the feed tokens to their file.
+func (ts *feedTokenStore) save() error {
+	ts.saveMu.Lock()
+	defer ts.saveMu.Unlock()
+
+	ts.mu.Lock()
+	// Without a file, tokens last only until we restart.
+	if ts.file == "" {
+		ts.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(ts.tokens, "", "\t")
+	ts.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("feedTokenStore: failed to marshal JSON: %v", err)
+	}
+
+	tmpFile := ts.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0600)
+	if err != nil {
+		return fmt.Errorf("feedTokenStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, ts.file)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+//
+// Gneto also proxies Finger, as described in RFC 1288 and RFC 4146.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Finger replies are small.
+const fingerMaxResponse = 256 * 1024
+
+// proxyFinger finds the Finger reply for u, which may name the user
+// either like finger://user@host or like finger://host/user.
+func proxyFinger(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL, error) {
+	var err error
+
+	query := strings.TrimPrefix(u.Path, "/")
+	if u.User != nil {
+		query = u.User.Username()
+	}
+	if strings.ContainsAny(query, "\r\n") {
+		return u, fmt.Errorf("proxyFinger: invalid query in %s", u.String())
+	}
+
+	conn, err := dialTCP(u, "79")
+	if err != nil {
+		return u, err
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "%s\r\n", query)
+	if optLogLevel > 1 {
+		log.Printf("proxyFinger: %s query '%s'", u.Host, query)
+	}
+
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.URL = u.String()
+	td.Title = "Gneto " + td.URL
+	td.Lang = stringOption(&optLang)
+	td.Private = privateMode(r)
+	td.User = sessionUser(r)
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	rd := bufio.NewReader(io.LimitReader(conn, fingerMaxResponse))
+	_, err = rd.Peek(1)
+	if err = checkTimeout(err, phaseHeader, u); isTimeout(err) {
+		return u, err
+	}
+	conn.SetDeadline(deadline(optBodyTimeout))
+
+	err = textToHTML(w, u, rd, td)
+
+	return u, err
+}
@@ -6,17 +6,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strings"
-	"time"
 )
 
 var htmlEscaper = strings.NewReplacer(
@@ -36,14 +39,28 @@ func geminiQueryEscape(q string) string {
 // The source URL is stored in u.
 func geminiToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td templateData) error {
 	var err error
-	list := false
-	pre := false
+	var doc gemDocument
 
-	if envPassword != "" {
-		td.Logout = true
+	if u.Scheme == "spartan" {
+		doc, err = parseSpartan(rd)
+	} else {
+		doc, err = parseGemini(rd)
 	}
-	if len(clientCerts) > 0 {
-		td.ManageCerts = true
+	var truncated *truncatedError
+	if errors.As(err, &truncated) {
+		log.Printf("geminiToHTML: cut off %s: %v", u.String(), err)
+	} else if err != nil {
+		if err = checkTimeout(err, phaseBody, u); isTimeout(err) {
+			return err
+		}
+		log.Printf("geminiToHTML: failed to read all of %s: %v", u.String(), err)
+	}
+
+	td.ImageToggle = !boolOption(&optTextOnly)
+	recordHistory(td, documentTitle(doc))
+
+	if loginRequired() {
+		td.Logout = true
 	}
 	err = tmpls.ExecuteTemplate(w, "header-only.html.tmpl", td)
 	if err != nil {
@@ -51,107 +68,21 @@ func geminiToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td templa
 		http.Error(w, "Internal Server Error", 500)
 	}
 
-	var eof error
-	var line string
-	for eof == nil {
-		line, eof = rd.ReadString("\n"[0])
-		if optLogLevel > 2 {
-			fmt.Println(line)
-		}
-		line = htmlEscaper.Replace(line)
-
-		if reGemPre.MatchString(line) {
-			if list {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-			if pre == true {
-				pre = false
-				io.WriteString(w, "</pre>\n")
-				continue
-			} else {
-				pre = true
-				// How can we provide alt text from reGemPre.FindStringSubmatch(line)[1]?
-				io.WriteString(w, "<pre>\n")
-				continue
-			}
-		} else {
-			if pre == true {
-				io.WriteString(w, line)
-				continue
-			}
-		}
-
-		if reGemBlank.MatchString(line) {
-			io.WriteString(w, "<br>\n")
-		} else if reGemH1.MatchString(line) {
-			if list == true {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-			io.WriteString(w, "<h1>"+reGemH1.FindStringSubmatch(line)[1]+"</h1>\n")
-		} else if reGemH2.MatchString(line) {
-			if list == true {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-			io.WriteString(w, "<h2>"+reGemH2.FindStringSubmatch(line)[1]+"</h2>\n")
-		} else if reGemH3.MatchString(line) {
-			if list == true {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-			io.WriteString(w, "<h3>"+reGemH3.FindStringSubmatch(line)[1]+"</h3>\n")
-		} else if reGemLink.MatchString(line) {
-			if list == true {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-
-			link := reGemLink.FindStringSubmatch(line)
-			lineURL, err := absoluteURL(u, link[1])
-			if err != nil {
-				io.WriteString(w, "<p>"+line+"</p>\n")
-			}
-			link[1] = lineURL.String()
-
-			if lineURL.Scheme == "gemini" {
-				if link[2] != "" {
-					io.WriteString(w, `<p><a href="/?url=`+geminiQueryEscape(link[1])+`">`+link[2]+
-						`</a> <span class="scheme"><a href="`+link[1]+`">[`+lineURL.Scheme+`]</a></span></p>`+"\n")
-				} else {
-					io.WriteString(w, `<p><a href="/?url=`+geminiQueryEscape(link[1])+`">`+link[1]+
-						`</a> <span class="scheme"><a href="`+link[1]+`">[`+lineURL.Scheme+`]</a></span></p>`+"\n")
-				}
-			} else {
-				if link[2] != "" {
-					io.WriteString(w, `<p><a href="`+link[1]+`">`+link[2]+
-						`</a> <span class="scheme"><a href="`+link[1]+`">[`+lineURL.Scheme+`]</a></span></p>`+"\n")
-				} else {
-					io.WriteString(w, `<p><a href="`+link[1]+`">`+link[1]+
-						`</a> <span class="scheme"><a href="`+link[1]+`">[`+lineURL.Scheme+`]</a></span></p>`+"\n")
-				}
-			}
-		} else if reGemList.MatchString(line) {
-			if list == false {
-				list = true
-				io.WriteString(w, "<ul>")
-			}
-			io.WriteString(w, "<li>"+reGemList.FindStringSubmatch(line)[1]+"</li>\n")
-		} else if reGemQuote.MatchString(line) {
-			if list == true {
-				list = false
-				io.WriteString(w, "</ul>")
-			}
-			io.WriteString(w, "<blockquote>"+reGemQuote.FindStringSubmatch(line)[1]+"</blockquote>\n")
+	opts := gemRenderOptions{InlineImages: td.Images, CSRF: td.CSRF}
+	if td.Images != boolOption(&optImages) {
+		if td.Images {
+			opts.Query = "&images=1"
 		} else {
-			if list {
-				list = false
-				io.WriteString(w, "</ul>\n")
-			}
-			io.WriteString(w, line+"<br>\n")
+			opts.Query = "&images=0"
 		}
 	}
+	err = writeGeminiHTML(w, u, doc, opts)
+	if err != nil {
+		log.Println("geminiToHTML:", err)
+	}
+	if truncated != nil {
+		writeTruncatedNotice(w, u, truncated)
+	}
 
 	err = tmpls.ExecuteTemplate(w, "footer-only.html.tmpl", td)
 	if err != nil {
@@ -162,6 +93,78 @@ func geminiToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td templa
 	return err
 }
 
+// fetchGemini requests the Gemini resource at u with user's client
+// certificate, if any, following redirects, and returns its MIME type and
+// body, up to limit MB. It's for Gneto's own use,
+// like polling feeds, rather than for showing pages to our user.
+func fetchGemini(u *url.URL, user string, limit int64) (string, []byte, error) {
+	redirects := intOption(&maxRedirects)
+	for i := 0; i <= redirects; i++ {
+		var clientCert tls.Certificate
+		if optHours != 0 {
+			clientCert = matchClientCert(u, user)
+		}
+
+		conn, err := dialGemini(u, clientCert)
+		if err != nil {
+			return "", nil, err
+		}
+		_, err = checkServerCert(u, conn)
+		if err != nil {
+			conn.Close()
+			return "", nil, err
+		}
+
+		fmt.Fprintf(conn, "%s\r\n", strings.SplitN(u.String(), "#", 2)[0])
+		rd := bufio.NewReader(conn)
+		status, err := rd.ReadString('\n')
+		status = strings.TrimRight(status, "\r\n")
+		if err != nil {
+			conn.Close()
+			return "", nil, checkTimeout(fmt.Errorf("fetchGemini: failed to read status line from %s: %w", u.Host, err), phaseHeader, u)
+		}
+		if !reStatus.MatchString(status) {
+			conn.Close()
+			return "", nil, fmt.Errorf("fetchGemini: invalid status line from %s: %s", u.Host, status)
+		}
+		conn.SetDeadline(deadline(optBodyTimeout))
+
+		switch status[0] {
+		case '2':
+			body, err := ioutil.ReadAll(limitBody(rd, "maxgemtext", limit))
+			conn.Close()
+			return strings.TrimSpace(status[2:]), body, checkTimeout(err, phaseBody, u)
+		case '3':
+			conn.Close()
+			ru, err := url.Parse(strings.TrimSpace(status[2:]))
+			if err != nil {
+				return "", nil, fmt.Errorf("fetchGemini: can't parse redirect URL %s: %v", status[2:], err)
+			}
+			u = u.ResolveReference(ru)
+		default:
+			conn.Close()
+			return "", nil, newGeminiStatusError(u, status)
+		}
+	}
+
+	return "", nil, fmt.Errorf("fetchGemini: too many redirects, ending at %s", u.String())
+}
+
+// inlineImages reports whether to show image links in the page requested by r
+// as images. The "images" query parameter overrides the --images option.
+func inlineImages(r *http.Request) bool {
+	if boolOption(&optTextOnly) {
+		return false
+	}
+	switch r.URL.Query().Get("images") {
+	case "0":
+		return false
+	case "1":
+		return true
+	}
+	return boolOption(&optImages)
+}
+
 // proxyGemini finds the Gemini content at u.
 func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL, error) {
 	var err error
@@ -171,7 +174,7 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 	// Section 1.2 of the Gemini spec forbids userinfo URL components.
 	u.User = nil
 
-	if optHomeFile != "" && u.Scheme == "file" {
+	if stringOption(&optHomeFile) != "" && u.Scheme == "file" {
 		if optLogLevel > 1 {
 			log.Println("proxyGemini: home:", u.String())
 		}
@@ -180,6 +183,7 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 			return u, fmt.Errorf("proxyGemini: failed to open home file: %v", err)
 		}
 		var td templateData
+		td.CSRF = csrfToken(w, r)
 		if u.Scheme == "file" {
 			td.Title = "Gneto"
 		} else {
@@ -187,50 +191,91 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 			td.Warning = warning
 			td.Title = "Gneto " + td.URL
 		}
-		geminiToHTML(w, u, bufio.NewReader(f), td)
-	}
-
-	var port string
-	if u.Port() != "" {
-		port = u.Port()
-	} else {
-		port = "1965"
+		err = geminiToHTML(w, u, bufio.NewReader(f), td)
+		f.Close()
+		return u, err
 	}
 
 	var clientCert tls.Certificate
-	var tc *tls.Config
 	if optHours != 0 {
-		clientCert = matchClientCert(u)
+		clientCert = matchClientCert(u, sessionUser(r))
 	}
-	if len(clientCert.Certificate) == 0 {
-		tc = &tls.Config{
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS12,
+
+	// Split the URL to avoid sending the fragment, if any, to the server.
+	request := strings.SplitN(u.String(), "#", 2)[0]
+
+	// Responses meant for a client certificate are cached for that
+	// certificate only, so one user never sees another's.
+	cacheKey := request
+	if len(clientCert.Certificate) > 0 {
+		cacheKey = fmt.Sprintf("%s %x", request, sha256.Sum256(clientCert.Certificate[0]))
+	}
+
+	// Never cache answers to input prompts or responses meant only for
+	// our client certificate, unless asked to.
+	cacheable := geminiCache != nil &&
+		(optCacheInput || u.RawQuery == "") &&
+		(optCacheAuth || len(clientCert.Certificate) == 0)
+
+	var cached []byte
+	var conn *tls.Conn
+	var body *idleConn
+	var recorder *cacheRecorder
+	if cacheable && r.URL.Query().Get("reload") == "" {
+		cached, _ = geminiCache.get(cacheKey)
+	}
+	if cached != nil {
+		if optLogLevel > 1 {
+			log.Println("proxyGemini: serving from cache:", request)
 		}
+		rd = bufio.NewReader(bytes.NewReader(cached))
 	} else {
-		tc = &tls.Config{
-			Certificates:       []tls.Certificate{clientCert},
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS12,
+		conn, err = dialGemini(u, clientCert)
+		if err != nil {
+			return u, err
 		}
-	}
-	conn, err := tls.Dial("tcp", u.Hostname()+":"+port, tc)
-	if err != nil {
-		return u, fmt.Errorf("proxyGemini: tls.Dial error to %s: %v", u.String(), err)
-	}
-	defer conn.Close()
+		defer conn.Close()
 
-	warning = checkServerCert(u, conn)
+		warning, err = checkServerCert(u, conn)
+		if err != nil {
+			var mismatch *certMismatchError
+			if !errors.As(err, &mismatch) {
+				return u, err
+			}
+			var td templateData
+			td.CSRF = csrfToken(w, r)
+			td.URL = u.String()
+			td.Title = "Gneto " + td.URL
+			if loginRequired() {
+				td.Logout = true
+			}
+			td.OldCert = mismatch.Old.info()
+			td.NewCert = mismatch.New.info()
+			err = tmpls.ExecuteTemplate(w, "tofu.html.tmpl", td)
+			if err != nil {
+				err = fmt.Errorf("proxyGemini: failed to execute TOFU template: %v", err)
+			}
+			return u, err
+		}
 
-	// Split the URL to avoid sending the fragment, if any, to the server.
-	fmt.Fprintf(conn, strings.SplitN(u.String(), "#", 2)[0]+"\r\n")
+		fmt.Fprintf(conn, "%s\r\n", request)
 
-	rd = bufio.NewReader(conn)
+		body = &idleConn{Conn: conn}
+		if cacheable {
+			recorder = &cacheRecorder{r: body, max: geminiCache.maxSize}
+			rd = bufio.NewReader(recorder)
+		} else {
+			rd = bufio.NewReader(body)
+		}
+	}
 
 	// Gemini specification section 3.1 forbids response headers not starting,
 	// with two digits, and a <META> longer than 1024 bytes.
-	header, _ := rd.Peek(1029)
+	header, err := rd.Peek(1029)
 	if !reGemResponseHeader.Match(header) {
+		if err = checkTimeout(err, phaseHeader, u); isTimeout(err) {
+			return u, err
+		}
 		if optLogLevel > 1 {
 			log.Printf("proxyGemini: server %s sent malformed header: %s", u.Host, string(header))
 		}
@@ -248,19 +293,20 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 	if !reStatus.MatchString(status) {
 		return u, fmt.Errorf("proxyGemini: invalid status line: %s", status)
 	}
+	if body != nil {
+		body.setBodyDeadline(status[0] == '2' && streamsBody(r, strings.TrimSpace(status[2:])))
+	}
 
 	switch status[0] {
 	case "1"[0]: // Status: input
 		var td templateData
+		td.CSRF = csrfToken(w, r)
 		td.URL = u.String()
 		td.Warning = warning
 		td.Title = "Gneto " + td.URL
-		if envPassword != "" {
+		if loginRequired() {
 			td.Logout = true
 		}
-		if len(clientCerts) > 0 {
-			td.ManageCerts = true
-		}
 		td.Meta = status[3:]
 		switch status[1] {
 		case "1"[0]: // 11 == sensitive input/password
@@ -277,48 +323,7 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 			}
 		}
 	case "2"[0]: // Status: success
-		if strings.Contains(status, " text/gemini") || len(strings.TrimSpace(status)) < 3 {
-			var td templateData
-			td.URL = u.String()
-			td.Title = "Gneto " + td.URL
-			c := reCharset.FindStringSubmatch(status)
-			if len(c) > 1 {
-				td.Charset = c[1]
-			} else {
-				td.Charset = "utf-8"
-			}
-			l := reLang.FindStringSubmatch(status)
-			if len(l) > 1 {
-				td.Lang = l[1]
-			} else {
-				td.Lang = optLang
-			}
-			if r.URL.Query().Get("source") != "" {
-				err = textToHTML(w, u, rd, td)
-			} else {
-				err = geminiToHTML(w, u, rd, td)
-			}
-			if err != nil {
-				break
-			}
-		} else if strings.Contains(status, " text") {
-			var td templateData
-			td.URL = u.String()
-			td.Title = "Gneto " + td.URL
-			err = textToHTML(w, u, rd, td)
-			if err != nil {
-				break
-			}
-		} else {
-			if optTextOnly {
-				err = fmt.Errorf("proxying of non-text types not allowed on this server")
-			} else {
-				err = serveFile(w, r, u, rd)
-			}
-			if err != nil {
-				break
-			}
-		}
+		err = serveSuccess(w, r, u, rd, strings.TrimSpace(status[2:]), warning)
 	case "3"[0]: // Status: redirect
 		var ru *url.URL
 		ru, err = url.Parse(strings.TrimSpace(strings.SplitAfterN(status, " ", 2)[1]))
@@ -343,38 +348,192 @@ func proxyGemini(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL,
 				break
 			}
 			http.Redirect(w, r, "/certificate?url="+geminiQueryEscape(u.String()), http.StatusFound)
-		default: // Client certificat not autorized, not valid, etc.
-			err = fmt.Errorf("proxyGemini: %s", status)
+		default: // Client certificate not authorized, not valid, etc.
+			err = newGeminiStatusError(u, status)
 		}
 	default: // Statuses 40-59 indicate various failures.
-		err = fmt.Errorf("proxyGemini: status: %s", status)
+		err = newGeminiStatusError(u, status)
+	}
+
+	if recorder != nil && status[0] == "2"[0] && err == nil {
+		if response := recorder.complete(); response != nil {
+			geminiCache.put(cacheKey, response)
+		}
 	}
 
 	return u, err
 }
 
-// serveFile saves a temporary file with the contents of rd, then serves it to w.
-func serveFile(w http.ResponseWriter, r *http.Request, u *url.URL, rd *bufio.Reader) error {
+// dialGemini opens a TLS connection to the Gemini server for u, presenting
+// clientCert if it's not empty. The connection has until the --headertimeout
+// deadline to start responding.
+func dialGemini(u *url.URL, clientCert tls.Certificate) (*tls.Conn, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(clientCert.Certificate) > 0 {
+		tc.Certificates = []tls.Certificate{clientCert}
+	}
+
+	raw, err := dialTCP(u, "1965")
+	if err != nil {
+		return nil, err
+	}
+
+	tc.ServerName = u.Hostname()
+	conn := tls.Client(raw, tc)
+	conn.SetDeadline(deadline(optTLSTimeout))
+	err = conn.Handshake()
+	if err != nil {
+		raw.Close()
+		return nil, checkTimeout(fmt.Errorf("proxyGemini: TLS handshake error with %s: %w", u.String(), err), phaseHandshake, u)
+	}
+	conn.SetDeadline(deadline(optHeaderTimeout))
+
+	return conn, err
+}
+
+// serveFile streams the contents of rd to w, with a Content-Type taken from
+// the MIME type in the Gemini response's meta. Browsers may show images,
+// audio, and video inline; they must download anything else.
+func serveFile(w http.ResponseWriter, r *http.Request, u *url.URL, rd *bufio.Reader, meta string) error {
 	var err error
-	fileName := u.String()[strings.LastIndex(u.String(), "/")+1:]
+	fileName := path.Base(u.Path)
+	if fileName == "/" || fileName == "." {
+		fileName = u.Hostname()
+	}
 
-	f, err := ioutil.TempFile("", "gneto*-"+fileName)
+	mediaType, _, err := mime.ParseMediaType(meta)
 	if err != nil {
-		err = fmt.Errorf("serveFile: failed to create temp file: %v", err)
+		mediaType = "application/octet-stream"
+		meta = mediaType
 	}
-	defer os.Remove(f.Name()) // clean up
 
-	if _, err := f.ReadFrom(rd); err != nil {
-		err = fmt.Errorf("serveFile: failed to write to temp file: %v", err)
+	disposition := "attachment"
+	switch strings.SplitN(mediaType, "/", 2)[0] {
+	case "audio", "image", "video":
+		disposition = "inline"
 	}
 
-	// Note: If we ever want to serve images inline, we'll have to revisit
-	// this content disposition header value.
-	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
-	http.ServeContent(w, r, fileName, time.Time{}, f)
+	w.Header().Set("Content-Type", meta)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	// Never let proxied content run scripts with the proxy's origin.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	if err := f.Close(); err != nil {
-		err = fmt.Errorf("serveFile: failed to close temp file: %v", err)
+	var src io.Reader = rd
+	if optMaxBinary > 0 {
+		src = io.LimitReader(rd, optMaxBinary*1024*1024)
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		// We've already sent headers, so all we can do is break off the
+		// response, so the browser knows the file is incomplete.
+		log.Printf("serveFile: failed after sending %d bytes of %s: %v", n, u.String(), err)
+		panic(http.ErrAbortHandler)
+	}
+	if optMaxBinary > 0 {
+		if _, err := rd.Peek(1); err == nil {
+			log.Printf("serveFile: truncated %s at the --maxbinary limit of %d MB", u.String(), optMaxBinary)
+		}
+	}
+
+	return nil
+}
+
+// serveImage sends the image in rd to w for display inline in a page.
+// Unlike serveFile, it refuses anything but images, and anything larger
+// than --maximage.
+func serveImage(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, meta string) error {
+	mediaType, _, err := mime.ParseMediaType(meta)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") || mediaType == "image/svg+xml" {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	img, err := ioutil.ReadAll(io.LimitReader(rd, optMaxImage*1024+1))
+	if err != nil {
+		log.Printf("serveImage: failed to read %s: %v", u.String(), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return nil
+	}
+	if int64(len(img)) > optMaxImage*1024 {
+		if optLogLevel > 0 {
+			log.Printf("serveImage: %s is larger than the --maximage limit of %d KB", u.String(), optMaxImage)
+		}
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(img)
+
+	return nil
+}
+
+// serveSuccess writes the body of a successful response from rd to w,
+// according to its MIME type, meta. An empty meta means text/gemini.
+func serveSuccess(w http.ResponseWriter, r *http.Request, u *url.URL, rd *bufio.Reader, meta string, warning string) error {
+	var err error
+
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.URL = u.String()
+	td.Warning = warning
+	td.Title = "Gneto " + td.URL
+	td.Private = privateMode(r)
+	td.User = sessionUser(r)
+
+	if meta == "" {
+		meta = "text/gemini"
+	}
+
+	if r.URL.Query().Get("raw") != "" {
+		return serveFile(w, r, u, rd, meta)
+	}
+	if r.URL.Query().Get("plain") != "" && strings.HasPrefix(meta, "text") {
+		_, charset, _ := decodeText(rd, meta)
+		return servePlainText(w, u, rd, charset)
+	}
+
+	if strings.HasPrefix(meta, "text/gemini") {
+		rd = limitBody(rd, "maxgemtext", optMaxGemtext)
+	} else if strings.HasPrefix(meta, "text") {
+		rd = limitBody(rd, "maxtext", optMaxText)
+	}
+	if strings.HasPrefix(meta, "text") {
+		var charset string
+		var ok bool
+		rd, charset, ok = decodeText(rd, meta)
+		if !ok {
+			return serveCharsetNotice(w, r, u, charset)
+		}
+	}
+
+	if strings.HasPrefix(meta, "text/gemini") {
+		l := reLang.FindStringSubmatch(meta)
+		if len(l) > 1 {
+			td.Lang = l[1]
+		} else {
+			td.Lang = stringOption(&optLang)
+		}
+		td.Images = inlineImages(r)
+		if r.URL.Query().Get("source") != "" {
+			err = textToHTML(w, u, rd, td)
+		} else {
+			err = geminiToHTML(w, u, rd, td)
+		}
+	} else if strings.HasPrefix(meta, "text") {
+		err = textToHTML(w, u, rd, td)
+	} else if boolOption(&optTextOnly) {
+		err = fmt.Errorf("proxying of non-text types not allowed on this server")
+	} else if r.URL.Query().Get("image") != "" {
+		err = serveImage(w, u, rd, meta)
+	} else {
+		err = serveFile(w, r, u, rd, meta)
 	}
 
 	return err
@@ -385,18 +544,17 @@ func serveFile(w http.ResponseWriter, r *http.Request, u *url.URL, rd *bufio.Rea
 func textToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td templateData) error {
 	var err error
 
-	if envPassword != "" {
+	if loginRequired() {
 		td.Logout = true
 	}
-	if len(clientCerts) > 0 {
-		td.ManageCerts = true
-	}
 	err = tmpls.ExecuteTemplate(w, "header-only.html.tmpl", td)
 	if err != nil {
 		log.Println("textToHTML:", err)
 		http.Error(w, "Internal Server Error", 500)
 	}
 
+	recordHistory(td, "")
+
 	io.WriteString(w, `<pre id="non-gemini-text">`+"\n")
 	var eof error
 	var line string
@@ -409,6 +567,11 @@ func textToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td template
 		io.WriteString(w, line+"\n")
 	}
 	io.WriteString(w, "</pre>\n")
+	var truncated *truncatedError
+	if errors.As(eof, &truncated) {
+		log.Printf("textToHTML: cut off %s: %v", u.String(), eof)
+		writeTruncatedNotice(w, u, truncated)
+	}
 
 	err = tmpls.ExecuteTemplate(w, "footer-only.html.tmpl", td)
 	if err != nil {
@@ -0,0 +1,338 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// gemLineType identifies the kind of a line in a text/gemini document.
+type gemLineType int
+
+const (
+	gemText gemLineType = iota
+	gemLink
+	gemHeading1
+	gemHeading2
+	gemHeading3
+	gemListItem
+	gemQuote
+	gemPre
+	gemPrompt
+)
+
+// gemLine is one node of a parsed text/gemini document.
+// A preformatted block, including every line between its toggle lines,
+// is a single gemLine whose Text holds the block's lines.
+type gemLine struct {
+	Type gemLineType
+	Text string // Line text, link label, or preformatted block contents.
+	URL  string // Link target as written, not yet resolved.
+	Alt  string // Alt text following the opening preformatting toggle.
+}
+
+// gemRenderOptions control how writeGeminiHTML renders a document.
+type gemRenderOptions struct {
+	InlineImages bool   // Show links to images as img elements.
+	Query        string // Added to proxied links, like "&images=1".
+	CSRF         string // Sent by forms, like those of Spartan prompts.
+}
+
+// gemDocument is a parsed text/gemini document.
+type gemDocument struct {
+	Lines []gemLine
+}
+
+// parseGemini reads text/gemini from rd, and returns it as a gemDocument.
+// The line types follow section 5.4 of the Gemini specification.
+func parseGemini(rd io.Reader) (gemDocument, error) {
+	return parseGemtext(rd, parseGeminiLine)
+}
+
+// parseSpartan is like parseGemini, but also knows Spartan's prompt lines.
+func parseSpartan(rd io.Reader) (gemDocument, error) {
+	return parseGemtext(rd, parseSpartanLine)
+}
+
+// parseGemtext reads text/gemini from rd, parsing each line outside
+// preformatted blocks with parseLine.
+func parseGemtext(rd io.Reader, parseLine func(string) gemLine) (gemDocument, error) {
+	var doc gemDocument
+	var pre *gemLine
+	var err error
+
+	br, ok := rd.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(rd)
+	}
+
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+		if optLogLevel > 2 {
+			fmt.Println(line)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if pre != nil {
+			if strings.HasPrefix(line, "```") {
+				doc.Lines = append(doc.Lines, *pre)
+				pre = nil
+			} else {
+				pre.Text += line + "\n"
+			}
+		} else if strings.HasPrefix(line, "```") {
+			pre = &gemLine{Type: gemPre, Alt: strings.TrimSpace(line[3:])}
+		} else {
+			doc.Lines = append(doc.Lines, parseLine(line))
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// An unterminated preformatted block runs to the end of the document.
+	if pre != nil {
+		doc.Lines = append(doc.Lines, *pre)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return doc, err
+}
+
+// documentTitle returns the text of the first level-one heading in doc,
+// if any.
+func documentTitle(doc gemDocument) string {
+	for _, l := range doc.Lines {
+		if l.Type == gemHeading1 {
+			return l.Text
+		}
+	}
+	return ""
+}
+
+// parseGeminiLine returns the gemLine for a single line outside a preformatted block.
+func parseGeminiLine(line string) gemLine {
+	switch {
+	case strings.HasPrefix(line, "=>"):
+		fields := strings.Fields(line[2:])
+		if len(fields) == 0 {
+			return gemLine{Type: gemText, Text: line}
+		}
+		label := strings.TrimSpace(strings.TrimLeftFunc(line[2:], unicode.IsSpace)[len(fields[0]):])
+		return gemLine{Type: gemLink, URL: fields[0], Text: label}
+	case strings.HasPrefix(line, "###"):
+		return gemLine{Type: gemHeading3, Text: strings.TrimSpace(line[3:])}
+	case strings.HasPrefix(line, "##"):
+		return gemLine{Type: gemHeading2, Text: strings.TrimSpace(line[2:])}
+	case strings.HasPrefix(line, "#"):
+		return gemLine{Type: gemHeading1, Text: strings.TrimSpace(line[1:])}
+	case strings.HasPrefix(line, "* "):
+		return gemLine{Type: gemListItem, Text: strings.TrimSpace(line[2:])}
+	case strings.HasPrefix(line, ">"):
+		return gemLine{Type: gemQuote, Text: strings.TrimSpace(line[1:])}
+	default:
+		return gemLine{Type: gemText, Text: line}
+	}
+}
+
+// parseSpartanLine is like parseGeminiLine, but also parses Spartan's
+// prompt line, which is like a link that takes input. In Gemini, it's text.
+func parseSpartanLine(line string) gemLine {
+	if strings.HasPrefix(line, "=:") {
+		l := parseGeminiLine("=>" + line[2:])
+		if l.Type != gemLink {
+			return gemLine{Type: gemText, Text: line}
+		}
+		l.Type = gemPrompt
+		return l
+	}
+	return parseGeminiLine(line)
+}
+
+// writeGeminiHTML writes the HTML equivalent of doc to w.
+// Relative links in doc are resolved against u.
+func writeGeminiHTML(w io.Writer, u *url.URL, doc gemDocument, opts gemRenderOptions) error {
+	var err error
+	list := false
+
+	for _, l := range doc.Lines {
+		if list && l.Type != gemListItem {
+			list = false
+			_, err = io.WriteString(w, "</ul>\n")
+			if err != nil {
+				return err
+			}
+		}
+
+		text := htmlEscaper.Replace(l.Text)
+
+		switch l.Type {
+		case gemHeading1:
+			_, err = io.WriteString(w, "<h1>"+text+"</h1>\n")
+		case gemHeading2:
+			_, err = io.WriteString(w, "<h2>"+text+"</h2>\n")
+		case gemHeading3:
+			_, err = io.WriteString(w, "<h3>"+text+"</h3>\n")
+		case gemLink:
+			err = writeGeminiLinkHTML(w, u, l, opts)
+		case gemListItem:
+			if !list {
+				list = true
+				_, err = io.WriteString(w, "<ul>")
+				if err != nil {
+					return err
+				}
+			}
+			_, err = io.WriteString(w, "<li>"+text+"</li>\n")
+		case gemQuote:
+			_, err = io.WriteString(w, "<blockquote>"+text+"</blockquote>\n")
+		case gemPre:
+			err = writeGeminiPreHTML(w, l)
+		case gemPrompt:
+			err = writeGeminiPromptHTML(w, u, l, opts)
+		default:
+			if strings.TrimSpace(l.Text) == "" {
+				_, err = io.WriteString(w, "<br>\n")
+			} else {
+				_, err = io.WriteString(w, text+"<br>\n")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if list {
+		_, err = io.WriteString(w, "</ul>\n")
+	}
+
+	return err
+}
+
+// writeGeminiLinkHTML writes link line l to w as an HTML paragraph.
+// Links to resources we can proxy point back through the proxy, and
+// links to Titan URLs point to our upload form.
+func writeGeminiLinkHTML(w io.Writer, u *url.URL, l gemLine, opts gemRenderOptions) error {
+	lineURL, err := absoluteURL(u, l.URL)
+	if err != nil || !(linkedScheme(lineURL.Scheme) || lineURL.Scheme == "titan") {
+		_, err = io.WriteString(w, "<p>"+htmlEscaper.Replace("=> "+l.URL+" "+l.Text)+"</p>\n")
+		return err
+	}
+
+	target := lineURL.String()
+	label := l.Text
+	if label == "" {
+		label = target
+	}
+
+	href := target
+	if proxiedScheme(lineURL.Scheme) {
+		if opts.InlineImages && isImagePath(lineURL.Path) {
+			_, err = io.WriteString(w, `<p class="inline-image"><a href="/?url=`+htmlEscaper.Replace(geminiQueryEscape(target))+
+				`"><img src="/?image=1&amp;url=`+htmlEscaper.Replace(geminiQueryEscape(target))+
+				`" alt="`+htmlEscaper.Replace(label)+`" loading="lazy"></a></p>`+"\n")
+			return err
+		}
+		href = "/?url=" + geminiQueryEscape(target) + opts.Query
+	} else if lineURL.Scheme == "titan" {
+		href = "/titan?url=" + geminiQueryEscape(target)
+	}
+
+	_, err = io.WriteString(w, `<p><a href="`+htmlEscaper.Replace(href)+`">`+htmlEscaper.Replace(label)+
+		`</a> <span class="scheme"><a href="`+htmlEscaper.Replace(target)+`">[`+
+		htmlEscaper.Replace(lineURL.Scheme)+`]</a></span></p>`+"\n")
+
+	return err
+}
+
+// writeGeminiPreHTML writes preformatted block l to w.
+// Alt text becomes the caption of the block, or, with --collapsepre,
+// the summary of a details element hiding the block.
+func writeGeminiPreHTML(w io.Writer, l gemLine) error {
+	var err error
+	alt := htmlEscaper.Replace(l.Alt)
+	text := htmlEscaper.Replace(l.Text)
+
+	if boolOption(&optCollapsePre) {
+		summary := alt
+		if summary == "" {
+			summary = "Preformatted text"
+		}
+		_, err = io.WriteString(w, `<details class="preformatted"><summary>`+summary+"</summary>\n<pre>\n"+text+"</pre>\n</details>\n")
+	} else if alt != "" {
+		_, err = io.WriteString(w, `<figure class="preformatted"><figcaption>`+alt+"</figcaption>\n"+
+			`<pre aria-label="`+alt+`">`+"\n"+text+"</pre>\n</figure>\n")
+	} else {
+		_, err = io.WriteString(w, "<pre>\n"+text+"</pre>\n")
+	}
+
+	return err
+}
+
+// proxiedScheme reports whether Gneto can proxy URLs with scheme.
+func proxiedScheme(scheme string) bool {
+	switch scheme {
+	case "finger", "gemini", "gopher", "spartan":
+		return true
+	}
+	return false
+}
+
+// linkedScheme reports whether pages we make may link to URLs with scheme.
+// Other schemes, like javascript: and data:, would run on our origin, where
+// they could read the CSRF token, so we show such URLs as text.
+func linkedScheme(scheme string) bool {
+	if scheme == "http" || scheme == "https" {
+		return true
+	}
+	return proxiedScheme(scheme)
+}
+
+// writeGeminiPromptHTML writes Spartan prompt line l to w as an inline form
+// that sends its input to the linked URL. Prompts for anything but Spartan
+// URLs are just links.
+func writeGeminiPromptHTML(w io.Writer, u *url.URL, l gemLine, opts gemRenderOptions) error {
+	lineURL, err := absoluteURL(u, l.URL)
+	if err != nil || lineURL.Scheme != "spartan" {
+		return writeGeminiLinkHTML(w, u, l, opts)
+	}
+
+	target := lineURL.String()
+	label := l.Text
+	if label == "" {
+		label = target
+	}
+
+	_, err = io.WriteString(w, `<form class="spartan-prompt" action="/" method="POST">`+"\n"+
+		`<input type="hidden" name="csrf" value="`+htmlEscaper.Replace(opts.CSRF)+`">`+"\n"+
+		`<input type="hidden" name="url" value="`+htmlEscaper.Replace(target)+`">`+"\n"+
+		`<label>`+htmlEscaper.Replace(label)+` <input type="text" name="input"></label>`+"\n"+
+		`<button>Submit</button>`+"\n</form>\n")
+
+	return err
+}
+
+// isImagePath reports whether p names a file type we may show inline.
+func isImagePath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".gif", ".jpeg", ".jpg", ".png", ".webp":
+		return true
+	}
+	return false
+}
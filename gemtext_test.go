@@ -0,0 +1,188 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseGeminiLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want gemLine
+	}{
+		{"plain text", gemLine{Type: gemText, Text: "plain text"}},
+		{"", gemLine{Type: gemText, Text: ""}},
+		{"=> gemini://example.com/ Example", gemLine{Type: gemLink, URL: "gemini://example.com/", Text: "Example"}},
+		{"=>gemini://example.com/", gemLine{Type: gemLink, URL: "gemini://example.com/"}},
+		{"=>  /a/b  A  label  ", gemLine{Type: gemLink, URL: "/a/b", Text: "A  label"}},
+		{"=>\t/tab\tTabbed label", gemLine{Type: gemLink, URL: "/tab", Text: "Tabbed label"}},
+		{"=>\u00a0 foo bar", gemLine{Type: gemLink, URL: "foo", Text: "bar"}},
+		{"=>\u3000foo\u3000bar baz", gemLine{Type: gemLink, URL: "foo", Text: "bar baz"}},
+		{"=>", gemLine{Type: gemText, Text: "=>"}},
+		{"=>   ", gemLine{Type: gemText, Text: "=>   "}},
+		{"=: /search Search", gemLine{Type: gemText, Text: "=: /search Search"}},
+		{"# Heading", gemLine{Type: gemHeading1, Text: "Heading"}},
+		{"#Heading", gemLine{Type: gemHeading1, Text: "Heading"}},
+		{"## Subheading", gemLine{Type: gemHeading2, Text: "Subheading"}},
+		{"### Sub-subheading", gemLine{Type: gemHeading3, Text: "Sub-subheading"}},
+		{"#### Four", gemLine{Type: gemHeading3, Text: "# Four"}},
+		{"* Item", gemLine{Type: gemListItem, Text: "Item"}},
+		{"*  Item ", gemLine{Type: gemListItem, Text: "Item"}},
+		{"*Not an item", gemLine{Type: gemText, Text: "*Not an item"}},
+		{"** Bold?", gemLine{Type: gemText, Text: "** Bold?"}},
+		{"> Quote", gemLine{Type: gemQuote, Text: "Quote"}},
+		{">Quote", gemLine{Type: gemQuote, Text: "Quote"}},
+		{" > Not a quote", gemLine{Type: gemText, Text: " > Not a quote"}},
+	}
+
+	for _, tt := range tests {
+		got := parseGeminiLine(tt.line)
+		if got != tt.want {
+			t.Errorf("parseGeminiLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseSpartanLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want gemLine
+	}{
+		{"=: /search Search", gemLine{Type: gemPrompt, URL: "/search", Text: "Search"}},
+		{"=:/search", gemLine{Type: gemPrompt, URL: "/search"}},
+		{"=:", gemLine{Type: gemText, Text: "=:"}},
+		{"=> /page Page", gemLine{Type: gemLink, URL: "/page", Text: "Page"}},
+		{"# Heading", gemLine{Type: gemHeading1, Text: "Heading"}},
+	}
+
+	for _, tt := range tests {
+		got := parseSpartanLine(tt.line)
+		if got != tt.want {
+			t.Errorf("parseSpartanLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseGemini(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []gemLine
+	}{
+		{
+			name: "CRLF line endings",
+			in:   "# Title\r\nText\r\n",
+			want: []gemLine{
+				{Type: gemHeading1, Text: "Title"},
+				{Type: gemText, Text: "Text"},
+			},
+		},
+		{
+			name: "no final newline",
+			in:   "one\ntwo",
+			want: []gemLine{
+				{Type: gemText, Text: "one"},
+				{Type: gemText, Text: "two"},
+			},
+		},
+		{
+			name: "preformatted toggle with alt text",
+			in:   "```  ASCII art \n=> not/a/link\n# not a heading\n```\nafter\n",
+			want: []gemLine{
+				{Type: gemPre, Alt: "ASCII art", Text: "=> not/a/link\n# not a heading\n"},
+				{Type: gemText, Text: "after"},
+			},
+		},
+		{
+			name: "closing toggle ignores trailing text",
+			in:   "```\ncode\n``` trailing\n",
+			want: []gemLine{
+				{Type: gemPre, Text: "code\n"},
+			},
+		},
+		{
+			name: "unterminated preformatted block",
+			in:   "```alt\ncode\n",
+			want: []gemLine{
+				{Type: gemPre, Alt: "alt", Text: "code\n"},
+			},
+		},
+		{
+			name: "empty preformatted block",
+			in:   "```\n```\n",
+			want: []gemLine{
+				{Type: gemPre},
+			},
+		},
+		{
+			name: "indented toggle is text",
+			in:   " ```\n",
+			want: []gemLine{
+				{Type: gemText, Text: " ```"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		doc, err := parseGemini(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: parseGemini: %v", tt.name, err)
+			continue
+		}
+		if len(doc.Lines) != len(tt.want) {
+			t.Errorf("%s: got %d lines %+v, want %d lines %+v", tt.name, len(doc.Lines), doc.Lines, len(tt.want), tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if doc.Lines[i] != tt.want[i] {
+				t.Errorf("%s: line %d = %+v, want %+v", tt.name, i, doc.Lines[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestDocumentTitle(t *testing.T) {
+	doc, err := parseGemini(strings.NewReader("## Not this\n# Title\n# Not this either\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := documentTitle(doc); got != "Title" {
+		t.Errorf("documentTitle = %q, want %q", got, "Title")
+	}
+}
+
+func TestWriteGeminiLinkHTML(t *testing.T) {
+	base, err := url.Parse("gemini://example.com/dir/page.gmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"other.gmi", `<p><a href="/?url=gemini:%2F%2Fexample.com%2Fdir%2Fother.gmi">Label</a>`},
+		{"https://example.org/?a=b&c", `<p><a href="https://example.org/?a=b&amp;c">Label</a>`},
+		{"titan://example.com/up", `<p><a href="/titan?url=titan:%2F%2Fexample.com%2Fup">Label</a>`},
+		{"javascript:alert(1)", "<p>=> javascript:alert(1) Label</p>\n"},
+		{"JavaScript:alert(1)", "<p>=> JavaScript:alert(1) Label</p>\n"},
+		{"data:text/html,x", "<p>=> data:text/html,x Label</p>\n"},
+		{"vbscript:x", "<p>=> vbscript:x Label</p>\n"},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		err := writeGeminiLinkHTML(&b, base, gemLine{Type: gemLink, URL: tt.url, Text: "Label"}, gemRenderOptions{})
+		if err != nil {
+			t.Errorf("writeGeminiLinkHTML(%q): %v", tt.url, err)
+			continue
+		}
+		if !strings.HasPrefix(b.String(), tt.want) {
+			t.Errorf("writeGeminiLinkHTML(%q) = %q, want prefix %q", tt.url, b.String(), tt.want)
+		}
+	}
+}
@@ -9,10 +9,10 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"bufio"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
@@ -27,76 +27,126 @@ import (
 )
 
 var muClientCerts sync.RWMutex
+var muClientCertsFile sync.Mutex
 var clientCerts []clientCertificate
 var clientCertsChanged bool
-var muCookies sync.RWMutex
-var cookies []http.Cookie
+var cmdLineOpts map[string]bool
+var configValues map[string]string
 var errRedirect error
+var failedLogins map[string]*loginFailures
+var feedTokens *feedTokenStore
+var geminiCache *responseCache
 var envPassword string
 var maxRedirects int
 var maxCookieLife time.Duration
 var optAddr string
+var optAddUser string
+var optBookmarksFile string
+var optCache int64
+var optCacheAuth bool
+var optCacheDir string
+var optCacheInput bool
+var optCacheTTL int
 var optCertFile string
 var optClientCertsFile string
+var optConfigFile string
+var optCollapsePre bool
 var optCSSFile string
+var optFeedInterval int
+var optHashPassword bool
+var optHistory bool
+var optHistoryDays int
 var optHomeFile string
 var optHours int
+var optImages bool
 var optKeyFile string
 var optLang string
 var optLogLevel int
+var optBodyTimeout int
+var optDialTimeout int
+var optHeaderTimeout int
+var optMaxBinary int64
+var optMaxGemtext int64
+var optMaxImage int64
+var optMaxText int64
+var optMaxUpload int64
 var optPort string
 var optRobots string
+var optStrict bool
+var optTLSTimeout int
+var optTransientKeyFile string
 var optTextOnly bool
 var optTrust bool
+var muLoginFailures sync.Mutex
+var muOptions sync.RWMutex
+var muProfiles sync.Mutex
+var profiles map[string]*profile
 var muServerCerts sync.RWMutex
 var serverCerts []serverCertificate
+var acceptedServerCerts map[string]string
+var pendingServerCerts map[string]serverCertificate
 var serverCertsChanged bool
 var reCharset *regexp.Regexp
-var reGemBlank *regexp.Regexp
-var reGemH1 *regexp.Regexp
-var reGemH2 *regexp.Regexp
-var reGemH3 *regexp.Regexp
-var reGemLink *regexp.Regexp
-var reGemList *regexp.Regexp
-var reGemPre *regexp.Regexp
 var reGemResponseHeader *regexp.Regexp
-var reGemQuote *regexp.Regexp
 var reLang *regexp.Regexp
+var reSpartanStatus *regexp.Regexp
 var reStatus *regexp.Regexp
+var reUserName *regexp.Regexp
+var sessions *sessionStore
 var tmpls *template.Template
+var users *userStore
 
 type templateData struct {
-	Certs       []clientCertificate
-	Charset     string
-	Count       int
-	Error       string
-	HTML        template.HTML
-	Lang        string
-	Logout      bool
-	ManageCerts bool
-	Meta        string
-	Title       string
-	URL         string
-	Warning     string
+	Admin         bool
+	Bookmark      bookmark
+	Bookmarks     []bookmarkFolder
+	Certs         []clientCertificate
+	Charset       string
+	Count         int
+	CSRF          string
+	Error         string
+	FeedEntries   []feedEntry
+	FeedToken     string
+	FeedTokenDate time.Time
+	Folder        string
+	Highlight     string
+	History       []historyDay
+	HTML          template.HTML
+	ImageToggle   bool
+	Images        bool
+	Lang          string
+	Logout        bool
+	Meta          string
+	MultiUser     bool
+	NewCert       serverCertInfo
+	Next          string
+	OldCert       serverCertInfo
+	Private       bool
+	Refresh       int
+	Search        string
+	SearchLinks   []searchLink
+	ServerCerts   []serverCertInfo
+	Sessions      []session
+	Status        int
+	Subscribe     string
+	Subscriptions []subscription
+	StatusText    string
+	Title         string
+	User          string
+	Users         []user
+	UploadURL     string
+	URL           string
+	Warning       string
 }
 
 // authenticate checks for a valid session cookie.
 func authenticate(r *http.Request) bool {
 	auth := false
 
-	if envPassword == "" {
+	if !loginRequired() {
 		auth = true
 	} else {
-		rc, err := r.Cookie("session")
-		if err == nil {
-			muCookies.RLock()
-			defer muCookies.RUnlock()
-			for _, c := range cookies {
-				if c.Value == rc.Value {
-					auth = true
-				}
-			}
-		}
+		_, auth = sessions.find(r)
 	}
 
 	return auth
@@ -114,61 +164,98 @@ func absoluteURL(baseURL *url.URL, lineURL string) (*url.URL, error) {
 	return baseURL.ResolveReference(u), err
 }
 
-// purgeOldCookies removes cookies older than maxCookieLife from cookies.
-func purgeOldCookies() {
-	for {
-		now := time.Now()
-		stale := 0
-
-		muCookies.Lock()
-		freshCookies := make([]http.Cookie, 0, len(cookies))
-		for _, c := range cookies {
-			if now.Sub(c.Expires) < maxCookieLife {
-				freshCookies = append(freshCookies, c)
-			} else {
-				stale++
-			}
-		}
-		cookies = freshCookies
-		muCookies.Unlock()
-
-		if optLogLevel > 1 {
-			log.Printf("purgeOldCookies: purged %d stale cookies, kept %d cookies", stale, len(cookies))
-		}
-
-		time.Sleep(time.Hour)
-	}
-}
-
 func init() {
 	mathrand.Seed(time.Now().Unix())
 
 	envPassword, _ = os.LookupEnv("password")
-	if envPassword != "" {
-		cookies = make([]http.Cookie, 0, 12)
-	}
 
+	flag.StringVar(&optAddUser, "adduser", "", "read a password from standard input, add an admin account with this name, and exit")
 	flag.StringVar(&optAddr, "addr", "127.0.0.1", "IP address on which to serve web interface")
+	flag.IntVar(&optBodyTimeout, "bodytimeout", 300, "seconds to wait for the whole body of a page, or between reads of a streamed file (zero for no limit)")
+	flag.StringVar(&optBookmarksFile, "bookmarks", "", "path to text/gemini bookmarks file (default: gneto/bookmarks.gmi in the user config directory)")
+	flag.Int64Var(&optCache, "cache", 16, "MB of Gemini responses to cache in memory (zero disables the cache)")
+	flag.BoolVar(&optCacheAuth, "cacheauth", false, "cache responses to requests sent with a client certificate")
+	flag.StringVar(&optCacheDir, "cachedir", "", "directory for an on-disk tier of the response cache")
+	flag.BoolVar(&optCacheInput, "cacheinput", false, "cache responses to submitted input")
+	flag.IntVar(&optCacheTTL, "cachettl", 10, "minutes to keep cached Gemini responses")
 	flag.StringVar(&optCertFile, "cert", "", "TLS certificate file for web interface")
 	flag.StringVar(&optClientCertsFile, "clientcerts", "", "path to JSON file listing peristent TLS client certificates")
+	flag.BoolVar(&optCollapsePre, "collapsepre", false, "collapse preformatted text, like ASCII art, behind its alt text")
+	flag.StringVar(&optConfigFile, "config", "", "path to config file (default: gneto/config in the user config directory)")
 	flag.StringVar(&optCSSFile, "css", "./web/gneto.css", "path to cascading style sheets file")
+	flag.IntVar(&optDialTimeout, "dialtimeout", 15, "seconds to wait to connect to a server (zero for no limit)")
+	flag.IntVar(&optFeedInterval, "feedinterval", 60, "minutes between checks of subscribed feeds (zero to check only on request)")
+	flag.IntVar(&optHeaderTimeout, "headertimeout", 30, "seconds to wait for a server to start responding (zero for no limit)")
 	flag.IntVar(&optLogLevel, "loglevel", 0, "print debugging output; 0=errors only, 1=verbose, 2=very verbose, 3=very very verbose")
+	flag.Int64Var(&optMaxBinary, "maxbinary", 0, "maximum MB of a non-text file to proxy (zero for no limit)")
+	flag.Int64Var(&optMaxGemtext, "maxgemtext", 8, "maximum MB of a Gemini page to show (zero for no limit)")
+	flag.Int64Var(&optMaxImage, "maximage", 2048, "maximum KB of an image to show inline")
+	flag.Int64Var(&optMaxText, "maxtext", 8, "maximum MB of other text, like plain text or a Gopher menu, to show (zero for no limit)")
+	flag.Int64Var(&optMaxUpload, "maxupload", 10, "maximum MB to upload with Titan")
+	flag.BoolVar(&optHashPassword, "hashpassword", false, "read a password from standard input, print a hash of it for the 'password' setting, and exit")
+	flag.BoolVar(&optHistory, "history", false, "keep a history of the pages we visit")
+	flag.IntVar(&optHistoryDays, "historydays", 90, "days to keep history (zero to keep it forever)")
 	flag.StringVar(&optHomeFile, "home", "", "Gemini file to show on home page")
 	flag.IntVar(&optHours, "hours", 72, "hours until transient client TLS certificates expire (zero disables client certs)")
+	flag.BoolVar(&optImages, "images", false, "show links to images inline in Gemini pages")
 	flag.StringVar(&optKeyFile, "key", "", "TLS key file for web interface")
 	flag.StringVar(&optLang, "lang", "en-US", "RFC4646 language for pages that do not supply one")
 	flag.IntVar(&maxRedirects, "r", 5, "maximum redirects to follow")
 	flag.StringVar(&optPort, "port", "8065", "port on which to serve web interface")
 	flag.StringVar(&optRobots, "robots", "./web/robots.txt", "path to robots.txt file")
+	flag.BoolVar(&optStrict, "strict", false, "refuse Gemini sites whose TLS certificate changed until we accept the new one")
 	flag.BoolVar(&optTextOnly, "textonly", false, "refuse to proxy non-text file types")
+	flag.IntVar(&optTLSTimeout, "tlstimeout", 15, "seconds to wait for a TLS handshake with a Gemini server (zero for no limit)")
+	flag.StringVar(&optTransientKeyFile, "transientkey", "", "path to the key that encrypts saved transient client certificates (default: gneto/transient-certs.key in the user config directory)")
 	flag.BoolVar(&optTrust, "trust", false, "don't warn about TLS certificate changes for visited Gemini sites")
-	flag.Parse()
+
+	reCharset = regexp.MustCompile(`(?i)\bcharset="?([\w.:-]+)`)
+	reGemResponseHeader = regexp.MustCompile(`^\d{2} (.*)\r\n`)
+	reLang = regexp.MustCompile(`\blang=([\w-]+)`)
+	reSpartanStatus = regexp.MustCompile(`^[2-5] .*`)
+	reStatus = regexp.MustCompile(`\d\d .*`)
+	reUserName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+	maxCookieLife = 90 * 24 * time.Hour
+}
+
+// setup reads the config file and the stores we keep in our config
+// directory, once we have parsed the command line.
+func setup() {
+	if optHashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Fatalln("setup: no password on standard input:", err)
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			log.Fatalln("setup:", err)
+		}
+		fmt.Println(hash)
+		os.Exit(0)
+	}
+
+	cmdLineOpts = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cmdLineOpts[f.Name] = true
+	})
+	err := loadConfig()
+	if err != nil {
+		log.Println("setup:", err)
+	}
+
+	failedLogins = make(map[string]*loginFailures)
 
 	if optAddr != "127.0.0.1" && (optHours != 0 || envPassword == "") {
 		log.Println("warning: review the Security Considerations in README.m, and consider settign the 'password' environment variable")
 	}
 
 	templateFiles := []string{
+		"./web/bookmarks.html.tmpl",
+		"./web/charset.html.tmpl",
+		"./web/feeds.html.tmpl",
+		"./web/history.html.tmpl",
 		"./web/home.html.tmpl",
 		"./web/footer.html.tmpl",
 		"./web/footer-only.html.tmpl",
@@ -177,99 +264,175 @@ func init() {
 		"./web/help.html.tmpl",
 		"./web/input.html.tmpl",
 		"./web/login.html.tmpl",
+		"./web/password.html.tmpl",
 		"./web/certificate.html.tmpl",
 		"./web/certificates.html.tmpl",
+		"./web/servers.html.tmpl",
+		"./web/sessions.html.tmpl",
+		"./web/status.html.tmpl",
+		"./web/timeout.html.tmpl",
+		"./web/titan.html.tmpl",
+		"./web/tofu.html.tmpl",
+		"./web/users.html.tmpl",
 	}
 	tmpls = template.Must(template.ParseFiles(templateFiles...))
 
-	reCharset = regexp.MustCompile(`\bcharset=([\w-]+)`)
-	reGemBlank = regexp.MustCompile(`^\s*$`)
-	reGemH1 = regexp.MustCompile(`^#\s*([^#].*)\s*`)
-	reGemH2 = regexp.MustCompile(`^##\s*([^#].*)\s*`)
-	reGemH3 = regexp.MustCompile(`^###\s*([^#].*)\s*`)
-	reGemLink = regexp.MustCompile(`^=>\s*(\S*)\s*(.*)`)
-	reGemList = regexp.MustCompile(`^\*\s(.*)\s*`)
-	reGemPre = regexp.MustCompile("^```(.*)")
-	reGemResponseHeader = regexp.MustCompile(`^\d{2} (.*)\r\n`)
-	reGemQuote = regexp.MustCompile(`^>\s(.*)\s*`)
-	reLang = regexp.MustCompile(`\blang=([\w-]+)`)
-	reStatus = regexp.MustCompile(`\d\d .*`)
-
-	maxCookieLife = 90 * 24 * time.Hour
-
 	if !optTrust {
 		serverCertsChanged = false
 		serverCerts = make([]serverCertificate, 0, 500)
+		acceptedServerCerts = make(map[string]string)
+		pendingServerCerts = make(map[string]serverCertificate)
+	} else if optStrict {
+		log.Println("warning: --trust disables --strict certificate checking")
+	}
+
+	if optCache > 0 {
+		geminiCache = newResponseCache(optCache*1024*1024, time.Duration(optCacheTTL)*time.Minute, optCacheDir)
+	}
+
+	sf, err := configPath("sessions.json")
+	if err == nil {
+		sessions, err = newSessionStore(sf)
+	}
+	if err != nil {
+		log.Println("setup:", err)
+	}
+	if sessions == nil {
+		sessions = &sessionStore{}
+	}
+
+	tf, err := configPath("feed-tokens.json")
+	if err == nil {
+		feedTokens, err = newFeedTokenStore(tf)
+	}
+	if err != nil {
+		log.Println("setup:", err)
+	}
+	if feedTokens == nil {
+		feedTokens = &feedTokenStore{}
+	}
+
+	uf, err := configPath("users.json")
+	if err == nil {
+		users, err = newUserStore(uf)
+	}
+	if err != nil {
+		log.Println("setup:", err)
+	}
+
+	if optAddUser != "" {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Fatalln("setup: no password on standard input:", err)
+		}
+		if users == nil {
+			log.Fatalln("setup: can't load user accounts")
+		}
+		err = users.add(optAddUser, password, true)
+		if err != nil {
+			log.Fatalln("setup:", err)
+		}
+		fmt.Printf("Added admin account '%s'\n", optAddUser)
+		os.Exit(0)
+	}
+
+	profiles = make(map[string]*profile)
+	userProfile("")
+	if users != nil {
+		for _, u := range users.list() {
+			userProfile(u.Name)
+		}
 	}
 
 	clientCerts = make([]clientCertificate, 0, 500)
 
+	if optClientCertsFile == "" {
+		cf, err := configPath("client-certs.json")
+		if err == nil {
+			if _, err := os.Stat(cf); err == nil {
+				optClientCertsFile = cf
+			}
+		}
+	}
+
 	if optClientCertsFile != "" {
 		var pCerts []persistentCert
 
 		jc, err := ioutil.ReadFile(optClientCertsFile)
 		if err != nil {
-			log.Printf("init: failed to read persistent TLS client certificates from JSON file '%s': %v", optClientCertsFile, err)
+			log.Printf("setup: failed to read persistent TLS client certificates from JSON file '%s': %v", optClientCertsFile, err)
 		} else {
 			err := json.Unmarshal(jc, &pCerts)
 			if err != nil {
-				log.Printf("init: failed to unmarshal JSON client certificates from '%s': %v", optClientCertsFile, err)
+				log.Printf("setup: failed to unmarshal JSON client certificates from '%s': %v", optClientCertsFile, err)
 			}
 		}
 
 		for _, pc := range pCerts {
-			var c clientCertificate
-			u, err := url.Parse(pc.URL)
-			if err != nil {
-				log.Printf("init: failed to parse URL %s in client certificate file '%s': %v", c.URL, optClientCertsFile, err)
-				continue
-			}
-			c.URL = pc.URL
-			c.Cert, err = tls.X509KeyPair([]byte(pc.CertPEM), []byte(pc.KeyPEM))
+			c, err := clientCertFromPEM(pc.URL, pc.CertPEM, pc.KeyPEM)
 			if err != nil {
-				log.Printf("init: failed to parse client certificate PEM data for %s: %v", c.URL, err)
+				log.Printf("setup: skipping client certificate in '%s': %v", optClientCertsFile, err)
 				continue
 			}
-			c.Leaf, err = x509.ParseCertificate(c.Cert.Certificate[0])
-			if err != nil {
-				log.Printf("init: failed to parse certificate leaf for %s: %v", pc.URL, err)
-				continue
-			}
-			c.Expires = c.Leaf.NotAfter.String()
-			c.CertName = c.Leaf.Subject.CommonName
-			c.Host = u.Host
-			c.Path = strings.Split(u.Path, "/")
-
+			c.User = pc.User
 			clientCerts = append(clientCerts, c)
 		}
 	}
 }
 
 func main() {
-	if envPassword != "" {
-		go purgeOldCookies()
-	}
+	flag.Parse()
+	setup()
+
+	go reloadConfig()
+
+	go purgeOldSessions()
 
 	if !optTrust {
 		go saveTOFU()
 	}
 
+	if geminiCache != nil && geminiCache.dir != "" {
+		go purgeOldCacheFiles(geminiCache)
+	}
+
+	if optHistory {
+		go saveHistory()
+	}
+
+	if optFeedInterval > 0 {
+		go pollFeeds()
+	}
+
 	if optHours > 0 {
+		loadTransientClientCerts()
+		go saveTransientClientCerts()
 		go purgeOldClientCertificates()
 	}
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", proxy)
+	mux.HandleFunc("/bookmarks", manageBookmarks)
 	mux.HandleFunc("/certificate", clientCertificateRequired)
 	mux.HandleFunc("/settings/certificates", manageClientCertificates)
+	mux.HandleFunc("/settings/servers", manageServerCertificates)
+	mux.HandleFunc("/settings/sessions", manageSessions)
+	mux.HandleFunc("/settings/users", manageUsers)
+	mux.HandleFunc("/titan", titanUpload)
+	mux.HandleFunc("/tofu", serverCertificateChanged)
+	mux.HandleFunc("/feed", serveAtom)
+	mux.HandleFunc("/feeds", manageFeeds)
+	mux.HandleFunc("/history", manageHistory)
 	mux.HandleFunc("/login", login)
 	mux.HandleFunc("/logout", logout)
 	mux.HandleFunc("/gneto.css", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, optCSSFile)
+		http.ServeFile(w, r, stringOption(&optCSSFile))
 	})
 	mux.HandleFunc("/help.html", func(w http.ResponseWriter, r *http.Request) {
 		var td templateData
+		td.CSRF = csrfToken(w, r)
 		td.Title = "Gneto Help"
 		err := tmpls.ExecuteTemplate(w, "help.html.tmpl", td)
 		if err != nil {
@@ -278,7 +441,7 @@ func main() {
 		}
 	})
 	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, optRobots)
+		http.ServeFile(w, r, stringOption(&optRobots))
 	})
 
 	if optCertFile != "" && optKeyFile != "" {
@@ -0,0 +1,3 @@
+module github.com/pgorman/gneto
+
+go 1.24
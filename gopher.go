@@ -0,0 +1,265 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+//
+// Gneto also proxies Gopher, as described in RFC 1436 and RFC 4266.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// gopherItem is one line of a Gopher menu.
+type gopherItem struct {
+	Type     byte
+	Display  string
+	Selector string
+	Host     string
+	Port     string
+}
+
+// gopherTypeNames labels the item types we show in menus.
+var gopherTypeNames = map[byte]string{
+	'0': "text",
+	'1': "menu",
+	'4': "binhex",
+	'5': "archive",
+	'7': "search",
+	'9': "binary",
+	'I': "image",
+	'g': "gif",
+	'h': "html",
+	's': "sound",
+}
+
+// gopherURL returns the gopher:// URL for item it.
+func (it gopherItem) gopherURL() *url.URL {
+	host := it.Host
+	if it.Port != "" && it.Port != "70" {
+		host = net.JoinHostPort(it.Host, it.Port)
+	}
+	return &url.URL{Scheme: "gopher", Host: host, Path: "/" + string(it.Type) + it.Selector}
+}
+
+// parseGopherURL returns the item type, selector, and search string of u.
+// A URL with an empty path is the server's root menu.
+func parseGopherURL(u *url.URL) (byte, string, string) {
+	var search string
+
+	p := u.Path
+	if p == "" || p == "/" {
+		return '1', "", ""
+	}
+	itemType := p[1]
+	selector := p[2:]
+
+	// RFC 4266 puts the search string after a tab, but Gneto's input
+	// form (like many clients) puts it in the query.
+	if split := strings.SplitN(selector, "\t", 2); len(split) == 2 {
+		selector = split[0]
+		search = split[1]
+	}
+	if u.RawQuery != "" {
+		search, _ = url.QueryUnescape(u.RawQuery)
+	}
+
+	return itemType, selector, search
+}
+
+// parseGopherItem parses one line of a Gopher menu.
+func parseGopherItem(line string) (gopherItem, bool) {
+	var it gopherItem
+
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" || line == "." {
+		return it, false
+	}
+	it.Type = line[0]
+	fields := strings.Split(line[1:], "\t")
+	it.Display = fields[0]
+	if len(fields) > 1 {
+		it.Selector = fields[1]
+	}
+	if len(fields) > 2 {
+		it.Host = fields[2]
+	}
+	if len(fields) > 3 {
+		it.Port = strings.TrimSpace(fields[3])
+	}
+
+	return it, true
+}
+
+// gopherMenuToHTML reads a Gopher menu from rd, and writes its HTML equivalent to w.
+func gopherMenuToHTML(w http.ResponseWriter, u *url.URL, rd *bufio.Reader, td templateData) error {
+	var err error
+
+	if loginRequired() {
+		td.Logout = true
+	}
+	err = tmpls.ExecuteTemplate(w, "header-only.html.tmpl", td)
+	if err != nil {
+		log.Println("gopherMenuToHTML:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+
+	recordHistory(td, "")
+
+	io.WriteString(w, `<pre id="gopher-menu">`+"\n")
+	var eof error
+	var line string
+	for eof == nil {
+		line, eof = rd.ReadString('\n')
+		if optLogLevel > 2 {
+			fmt.Println(line)
+		}
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		it, ok := parseGopherItem(line)
+		if !ok {
+			continue
+		}
+		display := htmlEscaper.Replace(it.Display)
+
+		switch it.Type {
+		case 'i', '3':
+			io.WriteString(w, `<span class="gopher-type"></span>`+display+"\n")
+		case 'h':
+			href := "/?url=" + geminiQueryEscape(it.gopherURL().String())
+			if strings.HasPrefix(it.Selector, "URL:") {
+				target := strings.TrimPrefix(it.Selector, "URL:")
+				hu, err := url.Parse(target)
+				if err != nil || !linkedScheme(hu.Scheme) {
+					io.WriteString(w, `<span class="gopher-type">[html]</span>`+display+" "+htmlEscaper.Replace(target)+"\n")
+					continue
+				}
+				href = hu.String()
+				if proxiedScheme(hu.Scheme) {
+					href = "/?url=" + geminiQueryEscape(href)
+				}
+			}
+			io.WriteString(w, `<span class="gopher-type">[html]</span><a href="`+htmlEscaper.Replace(href)+`">`+display+"</a>\n")
+		default:
+			name, ok := gopherTypeNames[it.Type]
+			if !ok {
+				name = "file"
+			}
+			href := "/?url=" + geminiQueryEscape(it.gopherURL().String())
+			io.WriteString(w, `<span class="gopher-type">[`+name+`]</span><a href="`+htmlEscaper.Replace(href)+`">`+display+"</a>\n")
+		}
+	}
+	io.WriteString(w, "</pre>\n")
+	var truncated *truncatedError
+	if errors.As(eof, &truncated) {
+		log.Printf("gopherMenuToHTML: cut off %s: %v", u.String(), eof)
+		writeTruncatedNotice(w, u, truncated)
+	}
+
+	err = tmpls.ExecuteTemplate(w, "footer-only.html.tmpl", td)
+	if err != nil {
+		log.Println("gopherMenuToHTML:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+
+	return err
+}
+
+// gopherMediaType guesses the MIME type of a Gopher item from its type and selector.
+func gopherMediaType(itemType byte, selector string) string {
+	if t := mime.TypeByExtension(path.Ext(selector)); t != "" {
+		return t
+	}
+	switch itemType {
+	case 'g':
+		return "image/gif"
+	case 'I':
+		return "image/png"
+	case 's':
+		return "audio/basic"
+	}
+	return "application/octet-stream"
+}
+
+// proxyGopher finds the Gopher content at u.
+func proxyGopher(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL, error) {
+	var err error
+
+	u.User = nil
+	itemType, selector, search := parseGopherURL(u)
+
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.URL = u.String()
+	td.Title = "Gneto " + td.URL
+	td.Lang = stringOption(&optLang)
+	td.Private = privateMode(r)
+	td.User = sessionUser(r)
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if itemType == '7' && search == "" {
+		td.Meta = "Search " + u.Host + selector
+		err = tmpls.ExecuteTemplate(w, "input.html.tmpl", td)
+		if err != nil {
+			err = fmt.Errorf("proxyGopher: failed to execute input template: %v", err)
+		}
+		return u, err
+	}
+
+	conn, err := dialTCP(u, "70")
+	if err != nil {
+		return u, err
+	}
+	defer conn.Close()
+
+	if search != "" {
+		fmt.Fprintf(conn, "%s\t%s\r\n", selector, search)
+	} else {
+		fmt.Fprintf(conn, "%s\r\n", selector)
+	}
+	if optLogLevel > 1 {
+		log.Printf("proxyGopher: %s type %c selector '%s'", u.Host, itemType, selector)
+	}
+
+	body := &idleConn{Conn: conn}
+	rd := bufio.NewReader(body)
+	_, err = rd.Peek(1)
+	if err = checkTimeout(err, phaseHeader, u); isTimeout(err) {
+		return u, err
+	}
+	text := itemType == '0' || itemType == '1' || itemType == '7' || itemType == 'h'
+	body.setBodyDeadline(r.URL.Query().Get("raw") != "" ||
+		(!text && !boolOption(&optTextOnly) && r.URL.Query().Get("image") == ""))
+
+	switch {
+	case r.URL.Query().Get("raw") != "":
+		err = serveFile(w, r, u, rd, gopherMediaType(itemType, selector))
+	case itemType == '1' || itemType == '7':
+		err = gopherMenuToHTML(w, u, limitBody(rd, "maxtext", optMaxText), td)
+	case itemType == '0' || itemType == 'h':
+		err = textToHTML(w, u, limitBody(rd, "maxtext", optMaxText), td)
+	default:
+		if boolOption(&optTextOnly) {
+			err = fmt.Errorf("proxying of non-text types not allowed on this server")
+		} else if r.URL.Query().Get("image") != "" {
+			err = serveImage(w, u, rd, gopherMediaType(itemType, selector))
+		} else {
+			err = serveFile(w, r, u, rd, gopherMediaType(itemType, selector))
+		}
+	}
+
+	return u, err
+}
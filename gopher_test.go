@@ -0,0 +1,40 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseGopherItem(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   gopherItem
+		wantOK bool
+		url    string
+	}{
+		{"1Menu\t/menu\texample.com\t70\r\n", gopherItem{'1', "Menu", "/menu", "example.com", "70"}, true, "gopher://example.com/1/menu"},
+		{"0About\tabout.txt\texample.com\t7070", gopherItem{'0', "About", "about.txt", "example.com", "7070"}, true, "gopher://example.com:7070/0about.txt"},
+		{"7Search\t/search\texample.com\t70 \t+", gopherItem{'7', "Search", "/search", "example.com", "70"}, true, "gopher://example.com/7/search"},
+		{"iJust text\tfake\t(NULL)\t0", gopherItem{'i', "Just text", "fake", "(NULL)", "0"}, true, ""},
+		{"hWeb\tURL:https://example.com/", gopherItem{'h', "Web", "URL:https://example.com/", "", ""}, true, ""},
+		{"iNo tabs", gopherItem{'i', "No tabs", "", "", ""}, true, ""},
+		{".\r\n", gopherItem{}, false, ""},
+		{"\r\n", gopherItem{}, false, ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseGopherItem(tt.line)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseGopherItem(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.wantOK)
+			continue
+		}
+		if tt.url != "" {
+			if u := got.gopherURL().String(); u != tt.url {
+				t.Errorf("parseGopherItem(%q).gopherURL() = %s, want %s", tt.line, u, tt.url)
+			}
+		}
+	}
+}
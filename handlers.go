@@ -5,22 +5,45 @@
 package main
 
 import (
-	cryptorand "crypto/rand"
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
+// certFileName returns a file name, without extension, for downloads of c.
+func certFileName(c clientCertificate) string {
+	name := strings.Trim(c.Host+strings.Join(c.Path, "-"), "-")
+	name = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" {
+		name = "gneto-client-cert"
+	}
+
+	return name
+}
+
 // clientCertificateRequired handles transient client certificate choices for our user.
 func clientCertificateRequired(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(r) {
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
 	var err error
@@ -30,15 +53,13 @@ func clientCertificateRequired(w http.ResponseWriter, r *http.Request) {
 			log.Println("clientCertificateRequired: asking user whether to create client certificate for:", r.URL.Query().Get("url"))
 		}
 		var td templateData
+		td.CSRF = csrfToken(w, r)
 		td.Title = "Gneto Client Certificate Confirmation"
 		td.URL = r.URL.Query().Get("url")
 		td.Count = optHours
-		if (envPassword) != "" {
+		if loginRequired() {
 			td.Logout = true
 		}
-		if len(clientCerts) > 0 {
-			td.ManageCerts = true
-		}
 		err = tmpls.ExecuteTemplate(w, "certificate.html.tmpl", td)
 		if err != nil {
 			log.Println("clientCertificateRequired:", err)
@@ -49,8 +70,9 @@ func clientCertificateRequired(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("clientCertificateRequired: failed to parse URL '%s': %v", r.FormValue("url"), err)
 			http.Error(w, "Internal Server Error", 500)
+			return
 		}
-		saveClientCert(u, r.FormValue("name"))
+		saveClientCert(u, r.FormValue("name"), sessionUser(r))
 		http.Redirect(w, r, "/?url="+geminiQueryEscape(r.FormValue("url")), http.StatusFound)
 	} else {
 		if optLogLevel > 0 {
@@ -60,38 +82,80 @@ func clientCertificateRequired(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// login displays the page requesting a password.
+// formFileOrValue returns the contents of the file uploaded as form field
+// name, or, if there is none, the field's text value.
+func formFileOrValue(r *http.Request, name string) (string, error) {
+	f, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return r.FormValue(name), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("formFileOrValue: failed to read uploaded %s: %v", name, err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("formFileOrValue: failed to read uploaded %s: %v", name, err)
+	}
+
+	return string(b), err
+}
+
+// login displays the page requesting a password, and, with user accounts,
+// a user name. A blank user name logs in with the shared password.
+// After each failed login, the IP address it came from must wait twice as
+// long before trying again.
 func login(w http.ResponseWriter, r *http.Request) {
 	var err error
+	var td templateData
+	td.Title = "Gneto Login"
+	td.MultiUser = users != nil && users.count() > 0
+
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	td.CSRF = csrfToken(w, r)
+	td.Next = localURL(r.FormValue("next"))
 
-	if r.Method == http.MethodPost && envPassword != "" {
-		if envPassword == r.FormValue("password") {
-			b := make([]byte, 32)
-			_, err = cryptorand.Read(b)
+	if delay := loginDelay(r); r.Method == http.MethodPost && delay > 0 {
+		log.Println("login: refusing to check a password from", r.RemoteAddr, "for", delay.Round(time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		td.Error = fmt.Sprintf("Too many failed logins. Try again in %v.", delay.Round(time.Second)+time.Second)
+	} else if r.Method == http.MethodPost && loginRequired() {
+		name := strings.TrimSpace(r.FormValue("user"))
+		var ok bool
+		if name == "" {
+			ok = checkSharedPassword(r.FormValue("password"))
+		} else {
+			ok = users != nil && users.check(name, r.FormValue("password"))
+		}
+		if ok {
+			succeedLogin(r)
+			var c http.Cookie
+			c, err = sessions.add(r, name)
 			if err != nil {
-				log.Println(err)
+				log.Println("login:", err)
+				http.Error(w, "Internal Server Error", 500)
+				return
 			}
-			c := http.Cookie{
-				Name:     "session",
-				Value:    base64.StdEncoding.EncodeToString(b),
-				Expires:  time.Now().Add(maxCookieLife),
-				HttpOnly: true,
+			err = sessions.save()
+			if err != nil {
+				log.Println("login:", err)
 			}
-			muCookies.Lock()
-			cookies = append(cookies, c)
-			muCookies.Unlock()
 			http.SetCookie(w, &c)
 			if optLogLevel > 0 {
-				log.Println("login: new login from", r.RemoteAddr)
+				log.Printf("login: new login for user '%s' from %s", name, r.RemoteAddr)
 			}
-			http.Redirect(w, r, "/", http.StatusFound)
-		} else {
-			log.Println("login: failed login from", r.RemoteAddr)
+			http.Redirect(w, r, td.Next, http.StatusFound)
+			return
 		}
+		delay := failLogin(r)
+		log.Printf("login: failed login for user '%s' from %s; next try allowed in %v", name, r.RemoteAddr, delay)
+		td.Error = "Wrong user name or password."
 	}
 
-	var td templateData
-	td.Title = "Gneto Login"
 	err = tmpls.ExecuteTemplate(w, "login.html.tmpl", td)
 	if err != nil {
 		log.Println("login:", err)
@@ -99,55 +163,158 @@ func login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// logout deletes a session cookie.
+// logout deletes a session cookie. It takes only a POST with our CSRF
+// token, so other sites can't log the user out.
 func logout(w http.ResponseWriter, r *http.Request) {
-	if envPassword == "" {
+	if !loginRequired() {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	rc, err := r.Cookie("session")
-	if err == nil {
-		muCookies.Lock()
-		defer muCookies.Unlock()
-		tc := make([]http.Cookie, len(cookies), len(cookies))
-		for _, c := range cookies {
-			if c.Value == rc.Value {
-				if optLogLevel > 1 {
-					log.Println("logout: removing cookie:", c.Value)
-				}
-				continue
+	if s, ok := sessions.find(r); ok {
+		if optLogLevel > 1 {
+			log.Printf("logout: ending session of user '%s' from %s", s.User, r.RemoteAddr)
+		}
+		sessions.revoke(s.User, s.Hash, "")
+		err := sessions.save()
+		if err != nil {
+			log.Println("logout:", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// manageBookmarks lets the user view, add, edit, delete, import, and export
+// bookmarks.
+func manageBookmarks(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Bookmarks"
+	bookmarks := userProfile(sessionUser(r)).bookmarks
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("export") != "" {
+		w.Header().Set("Content-Type", "text/gemini; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=bookmarks.gmi")
+		err = bookmarks.writeGemini(w)
+		if err != nil {
+			log.Println("manageBookmarks: failed to export bookmarks:", err)
+		}
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "save":
+			err = bookmarks.put(r.FormValue("old"), r.FormValue("url"), r.FormValue("title"), r.FormValue("folder"))
+		case "delete":
+			err = bookmarks.delete(r.FormValue("url"))
+		case "import":
+			var gmi string
+			gmi, err = formFileOrValue(r, "bookmarks")
+			if err != nil {
+				break
+			}
+			var n int
+			var skipped []string
+			n, skipped, err = bookmarks.importGemini(strings.NewReader(gmi))
+			if err != nil {
+				break
+			}
+			if optLogLevel > 0 {
+				log.Printf("manageBookmarks: imported %d bookmarks", n)
+			}
+			err = bookmarks.save()
+			if err == nil && len(skipped) > 0 {
+				err = fmt.Errorf("imported %d bookmarks, but skipped %d relative links, which need a full URL, like gemini://example.com/page: %s",
+					n, len(skipped), strings.Join(skipped, ", "))
 			}
-			tc = append(tc, c)
 		}
-		cookies = tc
+		if err == nil {
+			http.Redirect(w, r, "/bookmarks", http.StatusFound)
+			return
+		}
+		log.Println("manageBookmarks:", err)
+		td.Error = err.Error()
+	}
+
+	if rawURL := r.URL.Query().Get("edit"); rawURL != "" {
+		td.Bookmark, td.Folder, _ = bookmarks.find(rawURL)
+	} else if rawURL := r.URL.Query().Get("add"); rawURL != "" {
+		var ok bool
+		td.Bookmark, td.Folder, ok = bookmarks.find(rawURL)
+		if !ok {
+			td.Bookmark = bookmark{URL: rawURL, Title: r.URL.Query().Get("title")}
+		}
 	}
 
-	http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+	td.Bookmarks = bookmarks.list()
+	err = tmpls.ExecuteTemplate(w, "bookmarks.html.tmpl", td)
+	if err != nil {
+		log.Println("manageBookmarks:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
 }
 
-// manageClientCertificate lets the user view and delete client certificates.
+// manageClientCertificate lets the user view, delete, generate, upload,
+// and download client certificates.
 func manageClientCertificates(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(r) {
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
 	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Manage Client Certificates"
+	user := sessionUser(r)
+	if loginRequired() {
+		td.Logout = true
+	}
 
-	if r.Method == http.MethodGet {
-		var td templateData
-		td.Title = "Gneto Manage Client Certificates"
-		td.Certs = clientCerts
-		if (envPassword) != "" {
-			td.Logout = true
-		}
-		if len(clientCerts) > 0 {
-			td.ManageCerts = true
+	if r.Method == http.MethodGet && r.URL.Query().Get("download") == "pem" {
+		c, ok := findClientCert(r.URL.Query().Get("url"), user)
+		if !ok {
+			http.Error(w, "Not Found", 404)
+			return
 		}
-		err = tmpls.ExecuteTemplate(w, "certificates.html.tmpl", td)
+		pc, err := c.persistentCert()
 		if err != nil {
 			log.Println("manageClientCertificates:", err)
 			http.Error(w, "Internal Server Error", 500)
+			return
 		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", "attachment; filename="+certFileName(c)+".pem")
+		io.WriteString(w, pc.CertPEM+pc.KeyPEM)
+		return
 	}
 
 	if r.Method == http.MethodPost && r.FormValue("url") != "" && r.FormValue("delete") == "delete" {
@@ -155,20 +322,480 @@ func manageClientCertificates(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("manageClientCertificates: failed to parse URL '%s': %v", r.FormValue("url"), err)
 			http.Error(w, "Internal Server Error", 500)
+			return
 		}
-		err = deleteClientCert(u)
+		err = deleteClientCert(u, user)
 		if err != nil {
 			log.Printf("manageClientCertificates: failed to delete certificate for URL '%s': %v", r.FormValue("url"), err)
 			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		err = saveClientCertsFile()
+		if err != nil {
+			log.Println("manageClientCertificates:", err)
 		}
 		http.Redirect(w, r, "/settings/certificates", http.StatusFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "pkcs12":
+			c, ok := findClientCert(r.FormValue("url"), user)
+			if !ok {
+				http.Error(w, "Not Found", 404)
+				return
+			}
+			p12, err := encodePKCS12(c, r.FormValue("password"))
+			if err != nil {
+				log.Println("manageClientCertificates:", err)
+				http.Error(w, "Internal Server Error", 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-pkcs12")
+			w.Header().Set("Content-Disposition", "attachment; filename="+certFileName(c)+".p12")
+			w.Write(p12)
+			return
+		case "generate":
+			var u *url.URL
+			var c clientCertificate
+			u, err = parseCertURL(r.FormValue("url"))
+			if err != nil {
+				break
+			}
+			days, _ := strconv.Atoi(r.FormValue("days"))
+			c, err = generateClientCert(u, r.FormValue("name"), r.FormValue("keytype"), days)
+			if err != nil {
+				break
+			}
+			c.User = user
+			addClientCert(c)
+			err = saveClientCertsFile()
+		case "upload":
+			var u *url.URL
+			var c clientCertificate
+			u, err = parseCertURL(r.FormValue("url"))
+			if err != nil {
+				break
+			}
+			var certPEM, keyPEM string
+			certPEM, err = formFileOrValue(r, "cert")
+			if err != nil {
+				break
+			}
+			keyPEM, err = formFileOrValue(r, "key")
+			if err != nil {
+				break
+			}
+			if keyPEM == "" {
+				keyPEM = certPEM
+			}
+			c, err = clientCertFromPEM(u.String(), certPEM, keyPEM)
+			if err != nil {
+				break
+			}
+			c.User = user
+			addClientCert(c)
+			err = saveClientCertsFile()
+		}
+		if err == nil {
+			http.Redirect(w, r, "/settings/certificates", http.StatusFound)
+			return
+		}
+		log.Println("manageClientCertificates:", err)
+		td.Error = err.Error()
+	}
+
+	td.Highlight = r.URL.Query().Get("highlight")
+	td.Certs = listClientCerts(user)
+	err = tmpls.ExecuteTemplate(w, "certificates.html.tmpl", td)
+	if err != nil {
+		log.Println("manageClientCertificates:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// manageServerCertificates lets the user view, forget, re-pin, import, and
+// export the TLS server certificates we trust (TOFU).
+func manageServerCertificates(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Manage Server Certificates"
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if optTrust {
+		td.Error = "Server certificate checking is disabled by the --trust option."
+	} else if r.Method == http.MethodGet && r.URL.Query().Get("export") != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=gneto-tofu.txt")
+		err = exportServerCerts(w)
+		if err != nil {
+			log.Println("manageServerCertificates: failed to export server certificates:", err)
+		}
+		return
+	} else if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "forget":
+			if forgetServerCert(r.FormValue("host")) && optLogLevel > 0 {
+				log.Println("manageServerCertificates: forgot server certificate for", r.FormValue("host"))
+			}
+		case "repin":
+			err = repinServerCert(r.FormValue("host"))
+		case "import":
+			f, _, ferr := r.FormFile("tofu")
+			if ferr != nil {
+				err = fmt.Errorf("no file uploaded: %v", ferr)
+				break
+			}
+			var n int
+			n, err = importServerCerts(f)
+			f.Close()
+			if optLogLevel > 0 {
+				log.Printf("manageServerCertificates: imported %d server certificates", n)
+			}
+		}
+		if err == nil {
+			http.Redirect(w, r, "/settings/servers", http.StatusFound)
+			return
+		}
+		log.Println("manageServerCertificates:", err)
+		td.Error = err.Error()
+	}
+
+	td.ServerCerts = listServerCerts()
+	err = tmpls.ExecuteTemplate(w, "servers.html.tmpl", td)
+	if err != nil {
+		log.Println("manageServerCertificates:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// manageFeeds shows new posts in the feeds we subscribe to, and lets the
+// user subscribe, unsubscribe, and mark posts read.
+func manageFeeds(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Feeds"
+	feeds := userProfile(sessionUser(r)).feeds
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if feeds == nil {
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "subscribe":
+			err = feeds.subscribe(r.FormValue("url"))
+		case "unsubscribe":
+			feeds.remove(r.FormValue("url"))
+		case "open":
+			// Opening a post marks it read, so it's a POST, like any change.
+			feeds.markRead(r.FormValue("url"), "")
+			if serr := feeds.save(); serr != nil {
+				log.Println("manageFeeds:", serr)
+			}
+			http.Redirect(w, r, "/?url="+geminiQueryEscape(r.FormValue("url")), http.StatusFound)
+			return
+		case "read":
+			feeds.markRead("", r.FormValue("url"))
+		case "refresh":
+			feeds.poll(true)
+		case "token":
+			// We keep only a hash of the token, so this is our one chance to
+			// show it.
+			td.FeedToken, err = feedTokens.create(sessionUser(r))
+		case "revoketoken":
+			err = feedTokens.revoke(sessionUser(r))
+		}
+		if serr := feeds.save(); serr != nil {
+			log.Println("manageFeeds:", serr)
+		}
+		if err == nil && td.FeedToken == "" {
+			http.Redirect(w, r, "/feeds", http.StatusFound)
+			return
+		}
+		if err != nil {
+			log.Println("manageFeeds:", err)
+			td.Error = err.Error()
+			td.Subscribe = r.FormValue("url")
+		}
+	} else {
+		td.Subscribe = r.URL.Query().Get("add")
+	}
+
+	for _, e := range feeds.entries() {
+		if r.URL.Query().Get("unread") == "" || !e.Read {
+			td.FeedEntries = append(td.FeedEntries, e)
+		}
+	}
+	td.Subscriptions = feeds.list()
+	td.FeedTokenDate = feedTokens.created(sessionUser(r))
+	err = tmpls.ExecuteTemplate(w, "feeds.html.tmpl", td)
+	if err != nil {
+		log.Println("manageFeeds:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// manageHistory lets the user search and delete the history of pages we
+// visited, and turn private mode on and off.
+func manageHistory(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto History"
+	history := userProfile(sessionUser(r)).history
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "private":
+			c := http.Cookie{
+				Name:     "private",
+				Value:    "1",
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			}
+			if r.FormValue("private") != "on" {
+				c.Value = ""
+				c.MaxAge = -1
+			}
+			http.SetCookie(w, &c)
+		case "delete":
+			if history != nil && !history.delete(r.FormValue("id")) {
+				log.Printf("manageHistory: no history entry with ID '%s'", r.FormValue("id"))
+			}
+		case "clear":
+			if history != nil {
+				history.clear()
+			}
+		}
+		if history != nil {
+			err = history.save()
+			if err != nil {
+				log.Println("manageHistory:", err)
+			}
+		}
+		http.Redirect(w, r, "/history?q="+url.QueryEscape(r.FormValue("q")), http.StatusFound)
+		return
+	}
+
+	td.Private = privateMode(r)
+	td.Search = r.URL.Query().Get("q")
+	if history != nil {
+		td.History = history.search(td.Search)
+	} else {
+		td.Error = "Gneto keeps no history unless started with the --history option."
+	}
+
+	err = tmpls.ExecuteTemplate(w, "history.html.tmpl", td)
+	if err != nil {
+		log.Println("manageHistory:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// manageSessions lets our user see where they're logged in, and log out
+// any of those sessions.
+func manageSessions(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Sessions"
+	if loginRequired() {
+		td.Logout = true
+	}
+	current, _ := sessions.find(r)
+	td.User = current.User
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "revoke":
+			sessions.revoke(current.User, r.FormValue("hash"), "")
+		case "others":
+			sessions.revoke(current.User, "", current.Hash)
+		}
+		err = sessions.save()
+		if err != nil {
+			log.Println("manageSessions:", err)
+		}
+		http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+		return
+	}
+
+	if loginRequired() {
+		td.Sessions = sessions.list(current.User, current.Hash)
+	}
+	err = tmpls.ExecuteTemplate(w, "sessions.html.tmpl", td)
+	if err != nil {
+		log.Println("manageSessions:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// manageUsers lets admins add and delete user accounts, and lets each user
+// change their own password.
+func manageUsers(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Accounts"
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if users == nil {
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	td.User = sessionUser(r)
+	td.Admin = isAdmin(td.User)
+
+	if r.Method == http.MethodPost {
+		name := strings.TrimSpace(r.FormValue("name"))
+		switch r.FormValue("action") {
+		case "add":
+			if !td.Admin {
+				err = errors.New("only admins may add users")
+				break
+			}
+			err = users.add(name, r.FormValue("password"), r.FormValue("admin") == "on")
+			if err == nil {
+				userProfile(name)
+			}
+		case "delete":
+			if !td.Admin {
+				err = errors.New("only admins may delete users")
+			} else if name == td.User {
+				err = errors.New("you can't delete your own account")
+			} else {
+				err = deleteUser(name)
+			}
+		case "password":
+			if name == "" || name == td.User {
+				name = td.User
+				if name == "" {
+					err = errors.New("change the shared password with the 'password' environment variable or config option")
+					break
+				}
+				if !users.check(name, r.FormValue("current")) {
+					err = errors.New("the current password is wrong")
+					break
+				}
+			} else if !td.Admin {
+				err = errors.New("only admins may change other users' passwords")
+				break
+			}
+			err = users.setPassword(name, r.FormValue("password"))
+			if err != nil {
+				break
+			}
+			// Whoever stole a session shouldn't keep it past a password
+			// change. Users changing their own password stay logged in here.
+			current, _ := sessions.find(r)
+			if name != td.User {
+				current.Hash = ""
+			}
+			sessions.revoke(name, "", current.Hash)
+			err = sessions.save()
+		}
+		if err == nil {
+			http.Redirect(w, r, "/settings/users", http.StatusFound)
+			return
+		}
+		log.Println("manageUsers:", err)
+		td.Error = err.Error()
+	}
+
+	if td.Admin {
+		td.Users = users.list()
+	}
+	err = tmpls.ExecuteTemplate(w, "users.html.tmpl", td)
+	if err != nil {
+		log.Println("manageUsers:", err)
+		http.Error(w, "Internal Server Error", 500)
 	}
 }
 
+// parseCertURL parses the Gemini URL prefix at which a client certificate applies.
+func parseCertURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return u, fmt.Errorf("failed to parse URL '%s': %v", rawURL, err)
+	}
+	if u.Scheme != "gemini" || u.Host == "" {
+		return u, fmt.Errorf("'%s' is not a gemini:// URL", rawURL)
+	}
+
+	return u, err
+}
+
 // proxy handles requests not covered by another handler.
 func proxy(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(r) {
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
 	var err error
@@ -192,24 +819,23 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 		}
 
 		http.Redirect(w, r, "/?url="+geminiQueryEscape(targetURL), http.StatusFound)
+		return
 	}
 
 	if r.URL.Query().Get("url") == "" {
-		if optHomeFile != "" {
-			u, err := url.Parse(path.Join("file://", optHomeFile))
+		if home := stringOption(&optHomeFile); home != "" {
+			u, err := url.Parse(path.Join("file://", home))
 			if err != nil {
 				log.Println("proxy: failed to parse home file path to URL:", err)
 			}
 			proxyGemini(w, r, u)
 		} else {
 			var td templateData
+			td.CSRF = csrfToken(w, r)
 			td.Title = "Gneto"
-			if envPassword != "" {
+			if loginRequired() {
 				td.Logout = true
 			}
-			if len(clientCerts) > 0 {
-				td.ManageCerts = true
-			}
 			err = tmpls.ExecuteTemplate(w, "home.html.tmpl", td)
 			if err != nil {
 				log.Println("proxy:", err)
@@ -224,21 +850,33 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 		err = fmt.Errorf("proxy: failed to parse URL: %v", err)
 		log.Println(err)
 		http.Error(w, err.Error(), 500)
+		return
 	}
 
-	if u.Scheme == "gemini" {
-		for i := 0; i <= maxRedirects; i++ {
-			u, err = proxyGemini(w, r, u)
-			if u != nil && u.Scheme != "gemini" {
+	if proxiedScheme(u.Scheme) {
+		redirects := intOption(&maxRedirects)
+		for i := 0; i <= redirects; i++ {
+			switch u.Scheme {
+			case "gemini":
+				u, err = proxyGemini(w, r, u)
+			case "finger":
+				u, err = proxyFinger(w, r, u)
+			case "gopher":
+				u, err = proxyGopher(w, r, u)
+			case "spartan":
+				u, err = proxySpartan(w, r, u)
+			}
+			if u != nil && !proxiedScheme(u.Scheme) {
 				http.Redirect(w, r, u.String(), http.StatusFound)
+				return
 			}
 			if err != nil && errors.Is(err, errRedirect) {
-				if i < maxRedirects-1 {
+				if i < redirects-1 {
 					log.Printf("proxy: redirecting to %s\n", err)
 					continue
 				} else {
 					err = fmt.Errorf("too many redirects, ending at %s", u.String())
-					i = maxRedirects + 1
+					i = redirects + 1
 					break
 				}
 			}
@@ -256,19 +894,189 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 		}
 		var td templateData
+		td.CSRF = csrfToken(w, r)
 		td.Error = err.Error()
 		td.URL = u.String()
 		td.Title = "Gneto " + td.URL
-		if envPassword != "" {
+		if loginRequired() {
 			td.Logout = true
 		}
-		if len(clientCerts) > 0 {
-			td.ManageCerts = true
+		var se *geminiStatusError
+		var te *timeoutError
+		if errors.As(err, &se) {
+			err = serveStatusError(w, r, se)
+		} else if errors.As(err, &te) {
+			td.Meta = te.Phase
+			w.WriteHeader(http.StatusGatewayTimeout)
+			err = tmpls.ExecuteTemplate(w, "timeout.html.tmpl", td)
+		} else {
+			err = tmpls.ExecuteTemplate(w, "home.html.tmpl", td)
 		}
-		err = tmpls.ExecuteTemplate(w, "home.html.tmpl", td)
 		if err != nil {
 			log.Println(err)
 			http.Error(w, "Internal Server Error", 500)
 		}
 	}
 }
+
+// serverCertificateChanged handles our user's choice about a Gemini server
+// whose TLS certificate no longer matches the one we trust (see --strict).
+func serverCertificateChanged(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.FormValue("url") == "" {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil {
+		log.Printf("serverCertificateChanged: failed to parse URL '%s': %v", r.FormValue("url"), err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	switch r.FormValue("choice") {
+	case "once":
+		err = acceptServerCert(u.Host, false)
+	case "always":
+		err = acceptServerCert(u.Host, true)
+	default:
+		rejectServerCert(u.Host)
+		if optLogLevel > 0 {
+			log.Println("serverCertificateChanged: user rejected new certificate for", u.Host)
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Println("serverCertificateChanged:", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if optLogLevel > 0 {
+		log.Printf("serverCertificateChanged: user accepted new certificate for %s (%s)", u.Host, r.FormValue("choice"))
+	}
+
+	http.Redirect(w, r, "/?url="+geminiQueryEscape(u.String()), http.StatusFound)
+}
+
+// serveAtom serves the gemfeed or Atom feed at the "url" parameter as an
+// Atom feed for HTTP feed readers. With "full=1" the feed includes the
+// text of each entry. Feed readers can't log in, so they send the "token"
+// of a user instead.
+func serveAtom(w http.ResponseWriter, r *http.Request) {
+	var user string
+	if token := r.URL.Query().Get("token"); token != "" {
+		var ok bool
+		user, ok = feedTokens.find(token)
+		if !ok {
+			http.Error(w, "Forbidden: unknown or revoked feed token", http.StatusForbidden)
+			return
+		}
+	} else if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	} else {
+		user = sessionUser(r)
+	}
+
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Scheme != "gemini" || u.Host == "" {
+		http.Error(w, "Bad Request: url must be a gemini:// URL", http.StatusBadRequest)
+		return
+	}
+	u.Fragment = ""
+
+	title, entries, err := fetchFeed(u.String(), user)
+	if err != nil {
+		log.Println("serveAtom:", err)
+		var se *geminiStatusError
+		if errors.As(err, &se) {
+			http.Error(w, se.Error(), se.httpStatus())
+			return
+		}
+		http.Error(w, "Bad Gateway: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	err = writeAtomFeed(w, proxyBase(r), r.URL.RequestURI(), u, title, entries, r.URL.Query().Get("full") == "1", user)
+	if err != nil {
+		log.Println("serveAtom:", err)
+	}
+}
+
+// titanUpload shows a form for uploading text or a file to a Titan URL,
+// and sends what our user submits.
+func titanUpload(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		redirectToLogin(w, r)
+		return
+	}
+
+	var err error
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.Title = "Gneto Titan Upload"
+	if loginRequired() {
+		td.Logout = true
+	}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, optMaxUpload<<20+1<<20)
+		if !checkCSRF(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		td.UploadURL = r.FormValue("url")
+		var u *url.URL
+		u, err = titanURL(td.UploadURL)
+		if err == nil {
+			data := []byte(r.FormValue("text"))
+			mime := strings.TrimSpace(r.FormValue("mime"))
+			f, fh, ferr := r.FormFile("file")
+			if ferr == nil {
+				data, err = ioutil.ReadAll(io.LimitReader(f, optMaxUpload<<20+1))
+				f.Close()
+				if mime == "" {
+					mime = fh.Header.Get("Content-Type")
+				}
+			} else if ferr != http.ErrMissingFile {
+				err = fmt.Errorf("titanUpload: failed to read uploaded file: %v", ferr)
+			}
+			if mime == "" {
+				mime = "text/gemini"
+			}
+			if err == nil && int64(len(data)) > optMaxUpload<<20 {
+				err = fmt.Errorf("titanUpload: upload larger than --maxupload %d MB", optMaxUpload)
+			}
+			if err == nil {
+				err = uploadTitan(w, r, u, data, mime, r.FormValue("token"))
+				if err == nil {
+					return
+				}
+			}
+		}
+		log.Println(err)
+		td.Error = err.Error()
+	} else {
+		td.UploadURL = r.URL.Query().Get("url")
+		if u, err := titanURL(td.UploadURL); err == nil {
+			td.UploadURL = u.String()
+		}
+	}
+
+	err = tmpls.ExecuteTemplate(w, "titan.html.tmpl", td)
+	if err != nil {
+		log.Println("titanUpload:", err)
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
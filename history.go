@@ -0,0 +1,222 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyEntry is one visit to a page.
+type historyEntry struct {
+	Time  time.Time
+	URL   string
+	Title string
+}
+
+// historyDay is the visits of one day, newest first.
+type historyDay struct {
+	Date    string
+	Entries []historyEntry
+}
+
+// historyStore keeps the pages we visited, oldest first, in a file with a
+// tab-separated line for each visit.
+type historyStore struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	file    string
+	entries []historyEntry
+	changed bool
+}
+
+// ID identifies e to the history page's delete buttons.
+func (e historyEntry) ID() string {
+	return strconv.FormatInt(e.Time.UnixNano(), 10)
+}
+
+// Href returns the link to e's page through the proxy.
+func (e historyEntry) Href() string {
+	return "/?url=" + geminiQueryEscape(e.URL)
+}
+
+// newHistoryStore returns the history in file, which need not exist yet.
+func newHistoryStore(file string) (*historyStore, error) {
+	hs := &historyStore{file: file}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return hs, nil
+	}
+	if err != nil {
+		return hs, fmt.Errorf("newHistoryStore: failed to read '%s': %v", file, err)
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		e := historyEntry{Time: t, URL: fields[1]}
+		if len(fields) == 3 {
+			e.Title = fields[2]
+		}
+		hs.entries = append(hs.entries, e)
+	}
+
+	return hs, sc.Err()
+}
+
+// add records a visit to rawURL now. Reloading the page we just visited
+// updates that visit rather than adding another.
+func (hs *historyStore) add(rawURL, title string) {
+	title = strings.Join(strings.Fields(title), " ")
+	now := time.Now()
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if n := len(hs.entries); n > 0 && hs.entries[n-1].URL == rawURL {
+		hs.entries[n-1].Time = now
+		if title != "" {
+			hs.entries[n-1].Title = title
+		}
+	} else {
+		hs.entries = append(hs.entries, historyEntry{Time: now, URL: rawURL, Title: title})
+	}
+	hs.changed = true
+}
+
+// clear forgets every visit.
+func (hs *historyStore) clear() {
+	hs.mu.Lock()
+	hs.entries = nil
+	hs.changed = true
+	hs.mu.Unlock()
+}
+
+// delete forgets the visit with ID id.
+func (hs *historyStore) delete(id string) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for i, e := range hs.entries {
+		if e.ID() == id {
+			hs.entries = append(hs.entries[:i], hs.entries[i+1:]...)
+			hs.changed = true
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the visits whose URL or title contains query (ignoring
+// case), grouped by day, newest first.
+func (hs *historyStore) search(query string) []historyDay {
+	query = strings.ToLower(query)
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	var days []historyDay
+	for i := len(hs.entries) - 1; i >= 0; i-- {
+		e := hs.entries[i]
+		if query != "" && !strings.Contains(strings.ToLower(e.URL+" "+e.Title), query) {
+			continue
+		}
+		date := e.Time.Format("Monday, 2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, historyDay{Date: date})
+		}
+		days[len(days)-1].Entries = append(days[len(days)-1].Entries, e)
+	}
+
+	return days
+}
+
+// save writes the history to its file, dropping visits older than
+// --historydays, if anything changed.
+func (hs *historyStore) save() error {
+	hs.saveMu.Lock()
+	defer hs.saveMu.Unlock()
+
+	hs.mu.Lock()
+	if optHistoryDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -optHistoryDays)
+		i := 0
+		for i < len(hs.entries) && hs.entries[i].Time.Before(cutoff) {
+			i++
+		}
+		if i > 0 {
+			hs.entries = hs.entries[i:]
+			hs.changed = true
+		}
+	}
+	if !hs.changed {
+		hs.mu.Unlock()
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range hs.entries {
+		buf.WriteString(e.Time.Format(time.RFC3339Nano) + "\t" + e.URL + "\t" + e.Title + "\n")
+	}
+	hs.changed = false
+	hs.mu.Unlock()
+
+	tmpFile := hs.file + ".tmp"
+	err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("historyStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, hs.file)
+}
+
+// privateMode reports whether our user asked us not to record history.
+func privateMode(r *http.Request) bool {
+	c, err := r.Cookie("private")
+	return err == nil && c.Value == "1"
+}
+
+// recordHistory notes a visit to the page in td in the history of td.User,
+// unless --history is off or our user is in private mode.
+func recordHistory(td templateData, title string) {
+	if !optHistory || td.Private || td.URL == "" {
+		return
+	}
+	if p := userProfile(td.User); p.history != nil {
+		p.history.add(td.URL, title)
+	}
+}
+
+// saveHistory periodically saves every user's history to disk.
+func saveHistory() {
+	for {
+		time.Sleep(time.Minute)
+		for _, p := range loadedProfiles() {
+			if p.history == nil {
+				continue
+			}
+			err := p.history.save()
+			if err != nil {
+				log.Println("saveHistory:", err)
+			}
+		}
+	}
+}
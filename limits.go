@@ -0,0 +1,69 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+)
+
+// truncatedError reports that a response was larger than the limit (in MB)
+// set by the named option, so we stopped reading it.
+type truncatedError struct {
+	Option string
+	Limit  int64
+}
+
+func (e *truncatedError) Error() string {
+	return fmt.Sprintf("response larger than the --%s limit of %d MB", e.Option, e.Limit)
+}
+
+// limitedReader reads from r until it has read n bytes, then returns a
+// truncatedError if r has more to read, or io.EOF if not.
+type limitedReader struct {
+	r   *bufio.Reader
+	n   int64
+	err *truncatedError
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		if _, err := lr.r.Peek(1); err != nil {
+			return 0, err
+		}
+		return 0, lr.err
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
+
+// limitBody returns a reader of rd that stops after limit MB, as set by
+// option. A limit of zero means no limit.
+func limitBody(rd *bufio.Reader, option string, limit int64) *bufio.Reader {
+	if limit <= 0 {
+		return rd
+	}
+	return bufio.NewReader(&limitedReader{
+		r:   rd,
+		n:   limit * 1024 * 1024,
+		err: &truncatedError{Option: option, Limit: limit},
+	})
+}
+
+// writeTruncatedNotice tells our user that we cut off the page for u at
+// the limit in te, and offers the whole response as a download.
+func writeTruncatedNotice(w io.Writer, u *url.URL, te *truncatedError) error {
+	_, err := io.WriteString(w, `<div id="truncated">Gneto cut off this page, because it's larger than the --`+
+		te.Option+` limit of `+strconv.FormatInt(te.Limit, 10)+` MB. <a href="/?raw=1&amp;url=`+
+		htmlEscaper.Replace(geminiQueryEscape(u.String()))+`">Download the whole response</a></div>`+"\n")
+	return err
+}
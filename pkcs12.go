@@ -0,0 +1,266 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+)
+
+// We write PKCS#12 (RFC 7292) files the way OpenSSL 3 does by default:
+// the private key is shrouded with PBES2 (PBKDF2-HMAC-SHA256 and
+// AES-256-CBC), and the whole file is protected by an HMAC-SHA256.
+// Unlike OpenSSL, we leave the certificate itself unencrypted.
+
+// A downloaded file holds the private key, so we stretch its password as
+// much as we do account passwords, rather than OpenSSL's 2048 iterations.
+const pkcs12Iterations = passwordIterations
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509CertificateType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type pkcs12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type pkcs12CertBag struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12PBES2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pkcs12PBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// encodePKCS12 returns c's certificate and private key as a PKCS#12 file
+// protected by password.
+func encodePKCS12(c clientCertificate, password string) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.Cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("encodePKCS12: failed to marshal private key: %v", err)
+	}
+	certDER := c.Cert.Certificate[0]
+
+	keyID := sha1.Sum(certDER)
+	keyIDValue, err := asn1.Marshal(keyID[:])
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{{
+		ID:     oidLocalKeyID,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: keyIDValue},
+	}}
+
+	shroudedKey, err := pkcs12ShroudKey(keyDER, password)
+	if err != nil {
+		return nil, err
+	}
+	certOctets, err := asn1.Marshal(certDER)
+	if err != nil {
+		return nil, err
+	}
+	certBag, err := asn1.Marshal(pkcs12CertBag{
+		ID:    oidX509CertificateType,
+		Value: pkcs12Explicit(certOctets),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	safeContents, err := asn1.Marshal([]pkcs12SafeBag{
+		{ID: oidShroudedKeyBag, Value: pkcs12Explicit(shroudedKey), Attributes: attrs},
+		{ID: oidCertBag, Value: pkcs12Explicit(certBag), Attributes: attrs},
+	})
+	if err != nil {
+		return nil, err
+	}
+	safeOctets, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal([]pkcs12ContentInfo{{ContentType: oidData, Content: pkcs12Explicit(safeOctets)}})
+	if err != nil {
+		return nil, err
+	}
+	authSafeOctets, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 16)
+	_, err = rand.Read(macSalt)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12MacKey(password, macSalt, pkcs12Iterations))
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pkcs12PFX{
+		Version:  3,
+		AuthSafe: pkcs12ContentInfo{ContentType: oidData, Content: pkcs12Explicit(authSafeOctets)},
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// pkcs12Explicit wraps DER-encoded der in an explicit [0] tag.
+func pkcs12Explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// pkcs12ShroudKey encrypts PKCS#8 private key keyDER with PBES2, and returns
+// the DER of the resulting EncryptedPrivateKeyInfo.
+func pkcs12ShroudKey(keyDER []byte, password string) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, pkcs12Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(keyDER)%aes.BlockSize
+	plaintext := append(append([]byte{}, keyDER...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pkcs12PBKDF2Params{
+		Salt:       salt,
+		Iterations: pkcs12Iterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	pbes2Params, err := asn1.Marshal(pkcs12PBES2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: pbes2Params}},
+		EncryptedData: ciphertext,
+	})
+}
+
+// pkcs12MacKey derives the HMAC-SHA256 key for the PFX MAC, per the
+// PKCS#12 key derivation in appendix B.2 of RFC 7292 (ID 3, for MAC keys).
+// The key is no longer than one SHA-256 digest, so one round suffices.
+func pkcs12MacKey(password string, salt []byte, iterations int) []byte {
+	const u = sha256.Size
+	const v = sha256.BlockSize
+
+	// The password is a null-terminated big-endian BMPString.
+	var bmp []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+	bmp = append(bmp, 0, 0)
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{3}, v)
+	a := sha256.Sum256(append(append(d, fill(salt)...), fill(bmp)...))
+	for i := 1; i < iterations; i++ {
+		a = sha256.Sum256(a[:])
+	}
+
+	return a[:u]
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+// opensslPKCS12 is an ed25519 key and certificate exported with
+// "openssl pkcs12 -export -passout pass:secret -certpbe NONE -macalg sha256"
+// from OpenSSL 3.0.
+const opensslPKCS12 = `
+MIIC/QIBAzCCArMGCSqGSIb3DQEHAaCCAqQEggKgMIICnDCCAakGCSqGSIb3DQEHAaCCAZoEggGW
+MIIBkjCCAY4GCyqGSIb3DQEMCgEDoIIBVjCCAVIGCiqGSIb3DQEJFgGgggFCBIIBPjCCATowge2g
+AwIBAgIUNC6RnqCBYbyGhgRUVILZW2tajZwwBQYDK2VwMBIxEDAOBgNVBAMMB2ZpeHR1cmUwIBcN
+MjYxMDE2MTkwMjMxWhgPMjEyNjA5MjIxOTAyMzFaMBIxEDAOBgNVBAMMB2ZpeHR1cmUwKjAFBgMr
+ZXADIQCmLllLHLUw3A5+3Fq6yfy62tCHKe2wXQiXMbxKf27/G6NTMFEwHQYDVR0OBBYEFHeVOFCa
+ctVWDiZWJwATGoCLm9kTMB8GA1UdIwQYMBaAFHeVOFCactVWDiZWJwATGoCLm9kTMA8GA1UdEwEB
+/wQFMAMBAf8wBQYDK2VwA0EACzYc2oY6nQkwJMPZmm0h+0E7aIub0gypMg0huQrFNjeRKxJSVoCD
+9w1deeH+zHGeGZtxWmhxKOtaHkj4yd71BDElMCMGCSqGSIb3DQEJFTEWBBRSGuq7G293S5b6jiFq
+q3ErkdBDbDCB7AYJKoZIhvcNAQcBoIHeBIHbMIHYMIHVBgsqhkiG9w0BDAoBAqCBnjCBmzBXBgkq
+hkiG9w0BBQ0wSjApBgkqhkiG9w0BBQwwHAQIpzjMaunkoccCAggAMAwGCCqGSIb3DQIJBQAwHQYJ
+YIZIAWUDBAEqBBCuszIMfyAOL6O/xW4TyCa7BEAxmTYUbBYVNnW6NhjEO3mpIyfXziBYq1MP9B6p
+gs/sRu9CHIiyutxfrq6GjQOk4fCpKytxZr6L6rA0qH4kKK1CMSUwIwYJKoZIhvcNAQkVMRYEFFIa
+6rsbb3dLlvqOIWqrcSuR0ENsMEEwMTANBglghkgBZQMEAgEFAAQgHMD8hJm5NXXZgWSBR58Po7CZ
+ddip9OwKa7zQiI2GmZkECP030h0hx7+OAgIIAA==`
+
+// decodePKCS12 checks the MAC of PKCS#12 file der, as encodePKCS12 writes
+// it, and returns the certificate and the decrypted PKCS#8 private key.
+func decodePKCS12(der []byte, password string) (certDER, keyDER []byte, iterations int, err error) {
+	var pfx pkcs12PFX
+	if _, err = asn1.Unmarshal(der, &pfx); err != nil {
+		return nil, nil, 0, fmt.Errorf("PFX: %v", err)
+	}
+	var authSafe []byte
+	if _, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, 0, fmt.Errorf("authSafe: %v", err)
+	}
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA256) {
+		return nil, nil, 0, fmt.Errorf("MAC algorithm %v, want SHA-256", pfx.MacData.Mac.Algorithm.Algorithm)
+	}
+	mac := hmac.New(sha256.New, pkcs12MacKey(password, pfx.MacData.MacSalt, pfx.MacData.Iterations))
+	mac.Write(authSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		return nil, nil, 0, fmt.Errorf("MAC mismatch")
+	}
+
+	var contents []pkcs12ContentInfo
+	if _, err = asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, 0, fmt.Errorf("contents: %v", err)
+	}
+	for _, ci := range contents {
+		var safe []byte
+		if _, err = asn1.Unmarshal(ci.Content.Bytes, &safe); err != nil {
+			return nil, nil, 0, fmt.Errorf("safe contents: %v", err)
+		}
+		var bags []pkcs12SafeBag
+		if _, err = asn1.Unmarshal(safe, &bags); err != nil {
+			return nil, nil, 0, fmt.Errorf("bags: %v", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb pkcs12CertBag
+				if _, err = asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, 0, fmt.Errorf("cert bag: %v", err)
+				}
+				if _, err = asn1.Unmarshal(cb.Value.Bytes, &certDER); err != nil {
+					return nil, nil, 0, fmt.Errorf("cert: %v", err)
+				}
+			case bag.ID.Equal(oidShroudedKeyBag):
+				keyDER, iterations, err = unshroudPKCS12Key(bag.Value.Bytes, password)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+			}
+		}
+	}
+
+	return certDER, keyDER, iterations, nil
+}
+
+// unshroudPKCS12Key decrypts a PBES2 EncryptedPrivateKeyInfo.
+func unshroudPKCS12Key(der []byte, password string) ([]byte, int, error) {
+	var epki pkcs12EncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &epki); err != nil {
+		return nil, 0, fmt.Errorf("EncryptedPrivateKeyInfo: %v", err)
+	}
+	if !epki.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, 0, fmt.Errorf("key algorithm %v, want PBES2", epki.Algorithm.Algorithm)
+	}
+	var pbes2 pkcs12PBES2Params
+	if _, err := asn1.Unmarshal(epki.Algorithm.Parameters.FullBytes, &pbes2); err != nil {
+		return nil, 0, fmt.Errorf("PBES2 params: %v", err)
+	}
+	var kdf pkcs12PBKDF2Params
+	if _, err := asn1.Unmarshal(pbes2.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, 0, fmt.Errorf("PBKDF2 params: %v", err)
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) || !pbes2.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, 0, fmt.Errorf("PBES2 with %v and %v, want HMAC-SHA256 and AES-256-CBC", kdf.PRF.Algorithm, pbes2.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(pbes2.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, 0, fmt.Errorf("IV: %v", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, kdf.Salt, kdf.Iterations, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(iv) != aes.BlockSize || len(epki.EncryptedData)%aes.BlockSize != 0 || len(epki.EncryptedData) == 0 {
+		return nil, 0, fmt.Errorf("bad IV or ciphertext length")
+	}
+	plaintext := make([]byte, len(epki.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, epki.EncryptedData)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, 0, fmt.Errorf("bad padding")
+	}
+
+	return plaintext[:len(plaintext)-padding], kdf.Iterations, nil
+}
+
+// checkKeyPair reports an error unless keyDER is the private key of the
+// certificate certDER.
+func checkKeyPair(certDER, keyDER []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("key of type %T can't sign", key)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return fmt.Errorf("key doesn't match certificate")
+	}
+	return nil
+}
+
+// TestDecodeOpenSSLPKCS12 checks the decoder the other tests use, and
+// pkcs12MacKey, against a file OpenSSL made.
+func TestDecodeOpenSSLPKCS12(t *testing.T) {
+	der, err := base64.StdEncoding.DecodeString(opensslPKCS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := decodePKCS12(der, "wrong"); err == nil {
+		t.Error("decodePKCS12 with the wrong password succeeded")
+	}
+	certDER, keyDER, _, err := decodePKCS12(der, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyPair(certDER, keyDER); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	u, err := url.Parse("gemini://example.com/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyType := range []string{"ed25519", "rsa"} {
+		c, err := generateClientCert(u, "test", keyType, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const password = "pässwörd"
+		p12, err := encodePKCS12(c, password)
+		if err != nil {
+			t.Fatalf("%s: encodePKCS12: %v", keyType, err)
+		}
+
+		if _, _, _, err := decodePKCS12(p12, "wrong"); err == nil {
+			t.Errorf("%s: decodePKCS12 with the wrong password succeeded", keyType)
+		}
+		certDER, keyDER, iterations, err := decodePKCS12(p12, password)
+		if err != nil {
+			t.Fatalf("%s: decodePKCS12: %v", keyType, err)
+		}
+		if !bytes.Equal(certDER, c.Cert.Certificate[0]) {
+			t.Errorf("%s: certificate changed in the round trip", keyType)
+		}
+		wantKey, err := x509.MarshalPKCS8PrivateKey(c.Cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(keyDER, wantKey) {
+			t.Errorf("%s: private key changed in the round trip", keyType)
+		}
+		if iterations < passwordIterations {
+			t.Errorf("%s: key shrouded with %d PBKDF2 iterations, want at least %d", keyType, iterations, passwordIterations)
+		}
+	}
+}
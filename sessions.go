@@ -0,0 +1,250 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// session is a browser logged in as a user. We keep only a hash of the
+// token in its cookie, so a copy of the sessions file logs nobody in.
+type session struct {
+	Hash     string    `json:"hash"`
+	User     string    `json:"user"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"lastUsed"`
+	IP       string    `json:"ip"`
+	Device   string    `json:"device"`
+	Current  bool      `json:"-"`
+}
+
+// sessionStore keeps the sessions in a JSON file, so they survive restarts.
+type sessionStore struct {
+	mu       sync.Mutex
+	saveMu   sync.Mutex
+	file     string
+	sessions []session
+	changed  bool
+}
+
+// hashToken returns the hash by which we know the session with token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionStore returns the sessions in file, which need not exist yet.
+func newSessionStore(file string) (*sessionStore, error) {
+	ss := &sessionStore{file: file}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ss, nil
+	}
+	if err != nil {
+		return ss, fmt.Errorf("newSessionStore: failed to read '%s': %v", file, err)
+	}
+	err = json.Unmarshal(b, &ss.sessions)
+	if err != nil {
+		return ss, fmt.Errorf("newSessionStore: failed to unmarshal JSON from '%s': %v", file, err)
+	}
+
+	return ss, err
+}
+
+// add starts a session for user on the browser that sent r, and returns
+// the cookie to send it.
+func (ss *sessionStore) add(r *http.Request, user string) (http.Cookie, error) {
+	b := make([]byte, 32)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return http.Cookie{}, fmt.Errorf("sessionStore: failed to generate token: %v", err)
+	}
+	now := time.Now()
+	// Lax rather than Strict, so that following a link to us from another
+	// site, like an entry in one of our Atom feeds, finds the user logged
+	// in. The CSRF token, whose cookie is Strict, guards every POST.
+	c := http.Cookie{
+		Name:     "session",
+		Value:    base64.StdEncoding.EncodeToString(b),
+		Path:     "/",
+		Expires:  now.Add(maxCookieLife),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	device := r.UserAgent()
+	if len(device) > 256 {
+		device = device[:256]
+	}
+	ss.mu.Lock()
+	ss.sessions = append(ss.sessions, session{
+		Hash:     hashToken(c.Value),
+		User:     user,
+		Created:  now,
+		Expires:  c.Expires,
+		LastUsed: now,
+		IP:       remoteIP(r),
+		Device:   device,
+	})
+	ss.changed = true
+	ss.mu.Unlock()
+
+	return c, err
+}
+
+// find returns the unexpired session whose cookie r sent, noting when and
+// from where we last saw it.
+func (ss *sessionStore) find(r *http.Request) (session, bool) {
+	rc, err := r.Cookie("session")
+	if err != nil || rc.Value == "" {
+		return session{}, false
+	}
+	hash := hashToken(rc.Value)
+	now := time.Now()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for i := range ss.sessions {
+		s := &ss.sessions[i]
+		if s.Hash != hash {
+			continue
+		}
+		if now.After(s.Expires) {
+			return session{}, false
+		}
+		// Don't rewrite the file for every page; a minute is close enough.
+		if ip := remoteIP(r); now.Sub(s.LastUsed) > time.Minute || s.IP != ip {
+			s.LastUsed = now
+			s.IP = ip
+			ss.changed = true
+		}
+		return *s, true
+	}
+	return session{}, false
+}
+
+// list returns user's sessions, most recently used first, marking the one
+// whose hash is current.
+func (ss *sessionStore) list(user, current string) []session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var list []session
+	for _, s := range ss.sessions {
+		if s.User != user {
+			continue
+		}
+		s.Current = s.Hash == current
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsed.After(list[j].LastUsed) })
+	return list
+}
+
+// purge forgets expired sessions, and returns how many it forgot.
+func (ss *sessionStore) purge() int {
+	now := time.Now()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	fresh := make([]session, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		if now.Before(s.Expires) {
+			fresh = append(fresh, s)
+		}
+	}
+	expired := len(ss.sessions) - len(fresh)
+	if expired > 0 {
+		ss.sessions = fresh
+		ss.changed = true
+	}
+	return expired
+}
+
+// revoke ends user's sessions with hash hash, or, if hash is empty, all of
+// user's sessions but the one with hash except. It returns how many it ended.
+func (ss *sessionStore) revoke(user, hash, except string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	kept := make([]session, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		if s.User == user && (s.Hash == hash || (hash == "" && s.Hash != except)) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	revoked := len(ss.sessions) - len(kept)
+	if revoked > 0 {
+		ss.sessions = kept
+		ss.changed = true
+	}
+	return revoked
+}
+
+// save writes the sessions to their file, if anything changed. Saves take
+// turns under ss.saveMu, so two can't write the temporary file at once, or
+// rename an older copy of the sessions over a newer one.
+func (ss *sessionStore) save() error {
+	ss.saveMu.Lock()
+	defer ss.saveMu.Unlock()
+
+	ss.mu.Lock()
+	// Without a file, sessions last only until we restart.
+	if !ss.changed || ss.file == "" {
+		ss.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(ss.sessions, "", "\t")
+	ss.changed = false
+	ss.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("sessionStore: failed to marshal JSON: %v", err)
+	}
+
+	tmpFile := ss.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0600)
+	if err != nil {
+		return fmt.Errorf("sessionStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, ss.file)
+}
+
+// purgeOldSessions periodically forgets expired sessions and failed logins
+// from long ago, and saves the sessions.
+func purgeOldSessions() {
+	for {
+		expired := sessions.purge()
+		purgeLoginFailures()
+		err := sessions.save()
+		if err != nil {
+			log.Println("purgeOldSessions:", err)
+		}
+
+		if optLogLevel > 1 && expired > 0 {
+			log.Printf("purgeOldSessions: purged %d expired sessions", expired)
+		}
+
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+//
+// Gneto also proxies Spartan, as described at spartan://mozz.us/.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// proxySpartan finds the Spartan content at u.
+// Spartan sends any query string, percent-decoded, as the request's data.
+func proxySpartan(w http.ResponseWriter, r *http.Request, u *url.URL) (*url.URL, error) {
+	var err error
+
+	u.User = nil
+
+	var data string
+	if u.RawQuery != "" {
+		data, err = url.PathUnescape(u.RawQuery)
+		if err != nil {
+			return u, fmt.Errorf("proxySpartan: failed to decode query in %s: %v", u.String(), err)
+		}
+	}
+
+	conn, err := dialTCP(u, "300")
+	if err != nil {
+		return u, err
+	}
+	defer conn.Close()
+
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	fmt.Fprintf(conn, "%s %s %s\r\n%s", u.Hostname(), p, strconv.Itoa(len(data)), data)
+
+	body := &idleConn{Conn: conn}
+	rd := bufio.NewReader(body)
+	status, err := rd.ReadString('\n')
+	status = strings.TrimRight(status, "\r\n")
+	if err != nil {
+		return u, checkTimeout(fmt.Errorf("proxySpartan: failed to read status line from %s: %w", u.Host, err), phaseHeader, u)
+	}
+	if optLogLevel > 1 {
+		log.Printf("proxySpartan: %s status: %s", u.String(), status)
+	}
+	if !reSpartanStatus.MatchString(status) {
+		return u, fmt.Errorf("proxySpartan: invalid status line: %s", status)
+	}
+	meta := strings.TrimSpace(status[1:])
+	body.setBodyDeadline(status[0] == '2' && streamsBody(r, meta))
+
+	switch status[0] {
+	case '2': // Status: success
+		err = serveSuccess(w, r, u, rd, meta, "")
+	case '3': // Status: redirect, to a path on the same host
+		var ru *url.URL
+		ru, err = url.Parse(meta)
+		if err != nil {
+			err = fmt.Errorf("proxySpartan: can't parse redirect path %s: %v", meta, err)
+			break
+		}
+		u = u.ResolveReference(ru)
+		errRedirect = errors.New(u.String())
+		err = errRedirect
+	case '4': // Status: client error
+		err = fmt.Errorf("proxySpartan: client error: %s", meta)
+	default: // Status: server error
+		err = fmt.Errorf("proxySpartan: server error: %s", meta)
+	}
+
+	return u, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// geminiStatusError is a Gemini response with a failure status (4x, 5x, or 6x).
+type geminiStatusError struct {
+	Status int
+	Meta   string
+	URL    *url.URL
+}
+
+func (e *geminiStatusError) Error() string {
+	return fmt.Sprintf("proxyGemini: status: %d %s", e.Status, e.Meta)
+}
+
+// searchLink is a link to a search for a page we couldn't find.
+type searchLink struct {
+	Name string
+	URL  string
+}
+
+// geminiStatusNames are the names the Gemini specification gives failure statuses.
+var geminiStatusNames = map[int]string{
+	40: "Temporary Failure",
+	41: "Server Unavailable",
+	42: "CGI Error",
+	43: "Proxy Error",
+	44: "Slow Down",
+	50: "Permanent Failure",
+	51: "Not Found",
+	52: "Gone",
+	53: "Proxy Request Refused",
+	59: "Bad Request",
+	60: "Client Certificate Required",
+	61: "Certificate Not Authorized",
+	62: "Certificate Not Valid",
+}
+
+// geminiSearchEngines are offered when a page isn't found. Each takes its
+// query as the query string of the URL.
+var geminiSearchEngines = []searchLink{
+	{Name: "Kennedy", URL: "gemini://kennedy.gemi.dev/search"},
+	{Name: "TLGS", URL: "gemini://tlgs.one/search"},
+	{Name: "geminispace.info", URL: "gemini://geminispace.info/search"},
+}
+
+// newGeminiStatusError returns the geminiStatusError for status line status
+// in the response for u.
+func newGeminiStatusError(u *url.URL, status string) *geminiStatusError {
+	code, _ := strconv.Atoi(status[:2])
+	return &geminiStatusError{Status: code, Meta: strings.TrimSpace(status[2:]), URL: u}
+}
+
+// httpStatus returns the HTTP status that best matches e.
+func (e *geminiStatusError) httpStatus() int {
+	switch e.Status {
+	case 41:
+		return http.StatusServiceUnavailable
+	case 44:
+		return http.StatusTooManyRequests
+	case 51:
+		return http.StatusNotFound
+	case 52:
+		return http.StatusGone
+	case 53, 61, 62:
+		return http.StatusForbidden
+	case 59:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// name returns the name of e's status, or of its status family.
+func (e *geminiStatusError) name() string {
+	if name, ok := geminiStatusNames[e.Status]; ok {
+		return name
+	}
+	return geminiStatusNames[e.Status/10*10]
+}
+
+// searchTerms guesses what our user was looking for at u, from the last
+// element of its path, or else from its host.
+func searchTerms(u *url.URL) string {
+	base := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	if base == "/" || base == "." || base == "" {
+		return u.Hostname()
+	}
+	return strings.Join(strings.FieldsFunc(base, func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == '+'
+	}), " ")
+}
+
+// serveStatusError shows our user a page explaining failure status e.
+func serveStatusError(w http.ResponseWriter, r *http.Request, e *geminiStatusError) error {
+	var td templateData
+	td.CSRF = csrfToken(w, r)
+	td.URL = e.URL.String()
+	td.Title = "Gneto " + td.URL
+	if loginRequired() {
+		td.Logout = true
+	}
+	td.Status = e.Status
+	td.StatusText = e.name()
+	td.Meta = e.Meta
+
+	switch e.Status {
+	case 44:
+		// The server tells us how many seconds to wait.
+		td.Refresh, _ = strconv.Atoi(strings.TrimSpace(e.Meta))
+		if td.Refresh < 1 {
+			td.Refresh = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(td.Refresh))
+	case 51:
+		terms := searchTerms(e.URL)
+		for _, se := range geminiSearchEngines {
+			td.SearchLinks = append(td.SearchLinks, searchLink{
+				Name: se.Name,
+				URL:  "/?url=" + geminiQueryEscape(se.URL+"?"+geminiQueryEscape(terms)),
+			})
+		}
+	case 61, 62:
+		td.Highlight = matchClientCertURL(e.URL, sessionUser(r))
+	}
+
+	w.WriteHeader(e.httpStatus())
+	return tmpls.ExecuteTemplate(w, "status.html.tmpl", td)
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The phases of a request that may time out.
+const (
+	phaseDial      = "connecting to the server"
+	phaseHandshake = "negotiating TLS with the server"
+	phaseHeader    = "waiting for the server's response"
+	phaseBody      = "reading the server's response"
+)
+
+// timeoutError says which phase of a request for URL timed out.
+type timeoutError struct {
+	Phase string
+	URL   string
+	Err   error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out %s for %s: %v", e.Phase, e.URL, e.Err)
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.Err
+}
+
+// checkTimeout returns a timeoutError for phase if err is a network timeout,
+// or err unchanged otherwise.
+func checkTimeout(err error, phase string, u *url.URL) error {
+	var ne net.Error
+	if err != nil && errors.As(err, &ne) && ne.Timeout() {
+		return &timeoutError{Phase: phase, URL: u.String(), Err: err}
+	}
+	return err
+}
+
+// isTimeout reports whether err is, or wraps, a timeoutError.
+func isTimeout(err error) bool {
+	var te *timeoutError
+	return errors.As(err, &te)
+}
+
+// deadline returns the time seconds from now, or the zero time (no deadline)
+// if seconds is zero.
+func deadline(seconds int) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// idleConn is a connection whose read deadline, once setBodyDeadline lets
+// it stream, moves forward with every read. A long download then times out
+// only if the server stops sending.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.idle > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	}
+	return c.Conn.Read(p)
+}
+
+// setBodyDeadline gives the server --bodytimeout seconds to send a body we
+// buffer, or, if stream is true, to send each part of a body we stream.
+func (c *idleConn) setBodyDeadline(stream bool) {
+	if !stream || optBodyTimeout <= 0 {
+		c.Conn.SetDeadline(deadline(optBodyTimeout))
+		return
+	}
+	c.Conn.SetDeadline(time.Time{})
+	c.idle = time.Duration(optBodyTimeout) * time.Second
+}
+
+// streamsBody reports whether serveSuccess will stream the body of a
+// response of type meta to the browser, rather than reading all of it.
+func streamsBody(r *http.Request, meta string) bool {
+	if r.URL.Query().Get("raw") != "" {
+		return true
+	}
+	if meta == "" || strings.HasPrefix(meta, "text") {
+		return false
+	}
+	return !boolOption(&optTextOnly) && r.URL.Query().Get("image") == ""
+}
+
+// dialTCP connects to the server for u, on defaultPort if u names no port,
+// and gives it until the --headertimeout deadline to start responding.
+func dialTCP(u *url.URL, defaultPort string) (net.Conn, error) {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	d := net.Dialer{Timeout: time.Duration(optDialTimeout) * time.Second}
+	conn, err := d.Dial("tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return conn, checkTimeout(fmt.Errorf("dialTCP: failed to connect to %s: %w", u.Host, err), phaseDial, u)
+	}
+	conn.SetDeadline(deadline(optHeaderTimeout))
+
+	return conn, err
+}
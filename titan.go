@@ -0,0 +1,144 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+//
+// Gneto uploads to Titan servers, as described at
+// gemini://transjovian.org/titan.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// titanParamEscaper escapes the characters that would break a Titan parameter.
+var titanParamEscaper = strings.NewReplacer(
+	"%", "%25",
+	";", "%3B",
+	"=", "%3D",
+	" ", "%20",
+)
+
+// titanURL returns the titan:// URL for rawURL, which may be a Gemini URL,
+// without any Titan parameters.
+func titanURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return u, err
+	}
+	if u.Scheme != "titan" && u.Scheme != "gemini" {
+		return u, fmt.Errorf("titanURL: not a titan:// URL: %s", rawURL)
+	}
+	if u.Host == "" {
+		return u, fmt.Errorf("titanURL: URL has no host: %s", rawURL)
+	}
+	u.Scheme = "titan"
+	u.User = nil
+	u.Fragment = ""
+	u.RawQuery = ""
+	u.Path = strings.SplitN(u.Path, ";", 2)[0]
+	u.RawPath = ""
+
+	return u, err
+}
+
+// uploadTitan sends data of MIME type mime to Titan URL u, along with token
+// if it's not empty, and writes the server's Gemini-style response to w.
+// Our client certificate for the Gemini equivalent of u goes along too.
+func uploadTitan(w http.ResponseWriter, r *http.Request, u *url.URL, data []byte, mime string, token string) error {
+	var err error
+
+	gu := *u
+	gu.Scheme = "gemini"
+
+	var clientCert tls.Certificate
+	if optHours != 0 {
+		clientCert = matchClientCert(&gu, sessionUser(r))
+	}
+
+	conn, err := dialGemini(u, clientCert)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	warning, err := checkServerCert(&gu, conn)
+	if err != nil {
+		var mismatch *certMismatchError
+		if errors.As(err, &mismatch) {
+			return fmt.Errorf("uploadTitan: the TLS certificate of %s changed; visit %s to review it", u.Host, gu.String())
+		}
+		return err
+	}
+
+	params := ";size=" + strconv.Itoa(len(data))
+	if mime != "" {
+		params += ";mime=" + titanParamEscaper.Replace(mime)
+	}
+	if token != "" {
+		params += ";token=" + titanParamEscaper.Replace(token)
+	}
+	conn.SetDeadline(deadline(optBodyTimeout))
+	fmt.Fprintf(conn, "%s%s\r\n", u.String(), params)
+	_, err = conn.Write(data)
+	if err != nil {
+		return checkTimeout(fmt.Errorf("uploadTitan: failed to send %d bytes to %s: %w", len(data), u.Host, err), phaseBody, u)
+	}
+	conn.SetDeadline(deadline(optHeaderTimeout))
+	if optLogLevel > 1 {
+		log.Printf("uploadTitan: sent %d bytes to %s%s", len(data), u.String(), params)
+	}
+
+	rd := bufio.NewReader(conn)
+	header, err := rd.Peek(1029)
+	if !reGemResponseHeader.Match(header) {
+		if err = checkTimeout(err, phaseHeader, u); isTimeout(err) {
+			return err
+		}
+		return fmt.Errorf("uploadTitan: first 1029 bytes from %s did not contain a valid response header", u.Host)
+	}
+	status, err := rd.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("uploadTitan: failed to read status line: %v", err)
+	}
+	status = strings.TrimRight(status, "\r\n")
+	conn.SetDeadline(deadline(optBodyTimeout))
+	if optLogLevel > 1 {
+		log.Printf("uploadTitan: %s status: %s", u.String(), status)
+	}
+	meta := strings.TrimSpace(status[2:])
+
+	switch status[0] {
+	case '2': // Status: success
+		err = serveSuccess(w, r, &gu, rd, meta, warning)
+	case '3': // Status: redirect, usually to the page we changed
+		var ru *url.URL
+		ru, err = url.Parse(meta)
+		if err != nil {
+			return fmt.Errorf("uploadTitan: can't parse redirect URL %s: %v", meta, err)
+		}
+		ru = gu.ResolveReference(ru)
+		if ru.Scheme == "titan" {
+			ru.Scheme = "gemini"
+		}
+		http.Redirect(w, r, "/?url="+geminiQueryEscape(ru.String()), http.StatusFound)
+	case '6': // Status: client certificate required or refused
+		if status[1] == '0' && optHours != 0 {
+			http.Redirect(w, r, "/certificate?url="+geminiQueryEscape(gu.String()), http.StatusFound)
+			break
+		}
+		err = fmt.Errorf("uploadTitan: %s", status)
+	default:
+		err = fmt.Errorf("uploadTitan: status: %s", status)
+	}
+
+	return err
+}
@@ -0,0 +1,410 @@
+// Copyright 2020 Paul Gorman. Licensed under the GPL.
+
+// Gneto makes Gemini pages available over HTTP.
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// We hash passwords with PBKDF2-HMAC-SHA256, with this many iterations.
+const passwordIterations = 600000
+
+// minPasswordLength is the length of the shortest password we accept for
+// a user account.
+const minPasswordLength = 8
+
+// user is an account that can log in to Gneto.
+type user struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Admin bool   `json:"admin"`
+}
+
+// userStore keeps user accounts in a JSON file.
+type userStore struct {
+	mu     sync.Mutex
+	saveMu sync.Mutex
+	file   string
+	users  []user
+}
+
+// profile holds one user's bookmarks, feed subscriptions, and history.
+// The profile of the user with an empty name belongs to whoever logs in
+// with the shared password, or to everyone if there is no password.
+type profile struct {
+	bookmarks *bookmarkStore
+	feeds     *feedStore
+	history   *historyStore
+}
+
+// newUserStore returns the user accounts in file, which need not exist yet.
+func newUserStore(file string) (*userStore, error) {
+	us := &userStore{file: file}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return us, nil
+	}
+	if err != nil {
+		return us, fmt.Errorf("newUserStore: failed to read '%s': %v", file, err)
+	}
+	err = json.Unmarshal(b, &us.users)
+	if err != nil {
+		return us, fmt.Errorf("newUserStore: failed to unmarshal JSON from '%s': %v", file, err)
+	}
+
+	return us, err
+}
+
+// add creates an account for name, and saves the accounts.
+func (us *userStore) add(name, password string, admin bool) error {
+	if !reUserName.MatchString(name) {
+		return fmt.Errorf("userStore: user names must be 1 to 32 lowercase letters, digits, '-', or '_'")
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("userStore: passwords must be at least %d characters long", minPasswordLength)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	for _, u := range us.users {
+		if u.Name == name {
+			us.mu.Unlock()
+			return fmt.Errorf("userStore: user '%s' already exists", name)
+		}
+	}
+	us.users = append(us.users, user{Name: name, Hash: hash, Admin: admin})
+	us.mu.Unlock()
+
+	return us.save()
+}
+
+// admins returns how many accounts are admins.
+func (us *userStore) admins() int {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	n := 0
+	for _, u := range us.users {
+		if u.Admin {
+			n++
+		}
+	}
+	return n
+}
+
+// check reports whether password is name's password.
+func (us *userStore) check(name, password string) bool {
+	u, ok := us.find(name)
+	if !ok {
+		// Spend as long as a real check, so as not to reveal which names exist.
+		checkPassword("pbkdf2-sha256$"+strconv.Itoa(passwordIterations)+"$AAAAAAAAAAAAAAAAAAAAAA==$", password)
+		return false
+	}
+	return checkPassword(u.Hash, password)
+}
+
+// count returns the number of accounts.
+func (us *userStore) count() int {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return len(us.users)
+}
+
+// delete removes the account for name, and saves the accounts.
+func (us *userStore) delete(name string) error {
+	us.mu.Lock()
+	found := false
+	for i, u := range us.users {
+		if u.Name == name {
+			us.users = append(us.users[:i], us.users[i+1:]...)
+			found = true
+			break
+		}
+	}
+	us.mu.Unlock()
+	if !found {
+		return fmt.Errorf("userStore: no user '%s'", name)
+	}
+
+	return us.save()
+}
+
+// find returns the account for name.
+func (us *userStore) find(name string) (user, bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	for _, u := range us.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return user{}, false
+}
+
+// list returns the accounts, sorted by name, without their password hashes.
+func (us *userStore) list() []user {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	list := make([]user, 0, len(us.users))
+	for _, u := range us.users {
+		list = append(list, user{Name: u.Name, Admin: u.Admin})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// save writes the accounts to their file.
+func (us *userStore) save() error {
+	us.saveMu.Lock()
+	defer us.saveMu.Unlock()
+
+	us.mu.Lock()
+	b, err := json.MarshalIndent(us.users, "", "\t")
+	us.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("userStore: failed to marshal JSON: %v", err)
+	}
+
+	tmpFile := us.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, b, 0600)
+	if err != nil {
+		return fmt.Errorf("userStore: failed to write '%s': %v", tmpFile, err)
+	}
+
+	return os.Rename(tmpFile, us.file)
+}
+
+// setPassword changes name's password, and saves the accounts.
+func (us *userStore) setPassword(name, password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("userStore: passwords must be at least %d characters long", minPasswordLength)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	found := false
+	for i := range us.users {
+		if us.users[i].Name == name {
+			us.users[i].Hash = hash
+			found = true
+		}
+	}
+	us.mu.Unlock()
+	if !found {
+		return fmt.Errorf("userStore: no user '%s'", name)
+	}
+
+	return us.save()
+}
+
+// hashPassword returns a salted hash of password, in the form
+// "pbkdf2-sha256$iterations$salt$key", with base64 salt and key.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("hashPassword: failed to generate salt: %v", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", fmt.Errorf("hashPassword: %v", err)
+	}
+
+	return "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$" +
+		base64.StdEncoding.EncodeToString(salt) + "$" +
+		base64.StdEncoding.EncodeToString(key), nil
+}
+
+// checkPassword reports whether password matches hash, as made by
+// hashPassword.
+func checkPassword(hash, password string) bool {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+	if err != nil {
+		return false
+	}
+
+	return len(want) == len(key) && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// loginRequired reports whether our users must log in: when there's a
+// shared password or any user accounts.
+func loginRequired() bool {
+	return stringOption(&envPassword) != "" || (users != nil && users.count() > 0)
+}
+
+// sessionUser returns the name of the user logged in with r's session
+// cookie. It's empty for the shared password, or when there's no login.
+func sessionUser(r *http.Request) string {
+	if !loginRequired() {
+		return ""
+	}
+	s, _ := sessions.find(r)
+	return s.User
+}
+
+// isAdmin reports whether name may manage user accounts. The shared
+// password's user is an admin only until there's an admin account, since
+// anyone who knows the password can use it. Without a login, nobody is.
+func isAdmin(name string) bool {
+	if name == "" {
+		return stringOption(&envPassword) != "" && users.admins() == 0
+	}
+	u, ok := users.find(name)
+	return ok && u.Admin
+}
+
+// userConfigPath returns the path of the named file in the config
+// directory of the user called user, or in our own config directory for
+// the user with an empty name.
+func userConfigPath(user, name string) (string, error) {
+	if user == "" {
+		return configPath(name)
+	}
+	d, err := configPath(path.Join("users", user))
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(d, 0700)
+	if err != nil {
+		return "", fmt.Errorf("userConfigPath: unable to create config directory '%s': %v", d, err)
+	}
+
+	return path.Join(d, name), err
+}
+
+// loadProfile reads the bookmarks, feed subscriptions, and history of the
+// user called name from their config directory.
+func loadProfile(name string) *profile {
+	p := &profile{}
+
+	bf := optBookmarksFile
+	var err error
+	if name != "" || bf == "" {
+		bf, err = userConfigPath(name, "bookmarks.gmi")
+		if err != nil {
+			log.Println("loadProfile:", err)
+		}
+	}
+	p.bookmarks, err = newBookmarkStore(bf)
+	if err != nil {
+		log.Println("loadProfile:", err)
+	}
+
+	sf, err := userConfigPath(name, "subscriptions.json")
+	if err == nil {
+		p.feeds, err = newFeedStore(sf, name)
+	}
+	if err != nil {
+		log.Println("loadProfile:", err)
+	}
+
+	if optHistory {
+		hf, err := userConfigPath(name, "history.txt")
+		if err == nil {
+			p.history, err = newHistoryStore(hf)
+		}
+		if err != nil {
+			log.Println("loadProfile:", err)
+		}
+	}
+
+	return p
+}
+
+// userProfile returns the profile of the user called name, loading it the
+// first time we need it.
+func userProfile(name string) *profile {
+	muProfiles.Lock()
+	defer muProfiles.Unlock()
+
+	p, ok := profiles[name]
+	if !ok {
+		p = loadProfile(name)
+		profiles[name] = p
+	}
+	return p
+}
+
+// loadedProfiles returns the profiles we've loaded so far.
+func loadedProfiles() []*profile {
+	muProfiles.Lock()
+	defer muProfiles.Unlock()
+
+	list := make([]*profile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	return list
+}
+
+// deleteUser removes the account of the user called name, with their
+// sessions, client certificates, and profile.
+func deleteUser(name string) error {
+	err := users.delete(name)
+	if err != nil {
+		return err
+	}
+
+	sessions.revoke(name, "", "")
+	err = feedTokens.revoke(name)
+	if err != nil {
+		log.Println("deleteUser:", err)
+	}
+	deleteUserClientCerts(name)
+	err = saveClientCertsFile()
+	if err != nil {
+		log.Println("deleteUser:", err)
+	}
+
+	muProfiles.Lock()
+	delete(profiles, name)
+	muProfiles.Unlock()
+
+	d, err := configPath(path.Join("users", name))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(d)
+}